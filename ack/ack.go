@@ -0,0 +1,72 @@
+// Package ack implements signed, expiring links which acknowledge an alert
+// when opened, so they can be embedded in notifications
+package ack
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tengattack/esalert/config"
+)
+
+// Path is the path of the management api acknowledgement links point to
+const Path = "/ack"
+
+func sign(name string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(config.Opts.AckSecret))
+	mac.Write([]byte(name + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// URL returns a link acknowledging the named alert, which is valid for the
+// ack-link-ttl runtime config
+func URL(name string) (string, error) {
+	if config.Opts.AckURL == "" || config.Opts.AckSecret == "" {
+		return "", errors.New("ack url or secret not set in config")
+	}
+	expires := time.Now().Add(config.Opts.AckLinkTTL).Unix()
+	q := url.Values{}
+	q.Set("alert", name)
+	q.Set("expires", strconv.FormatInt(expires, 10))
+	q.Set("sig", sign(name, expires))
+	return strings.TrimRight(config.Opts.AckURL, "/") + Path + "?" + q.Encode(), nil
+}
+
+// VerifyToken checks the Authorization header of an acknowledgement api
+// request, which must be the ack secret as a bearer token
+func VerifyToken(header string) error {
+	if config.Opts.AckSecret == "" {
+		return errors.New("ack secret not set in config")
+	}
+	token := strings.TrimPrefix(header, "Bearer ")
+	if token == header || !hmac.Equal([]byte(token), []byte(config.Opts.AckSecret)) {
+		return errors.New("invalid or missing bearer token")
+	}
+	return nil
+}
+
+// Verify checks the query of an acknowledgement link, and returns the name
+// of the alert it acknowledges
+func Verify(q url.Values) (string, error) {
+	if config.Opts.AckSecret == "" {
+		return "", errors.New("ack links are not enabled")
+	}
+	name := q.Get("alert")
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if name == "" || err != nil {
+		return "", errors.New("invalid ack link")
+	}
+	if !hmac.Equal([]byte(sign(name, expires)), []byte(q.Get("sig"))) {
+		return "", errors.New("invalid ack link signature")
+	}
+	if time.Now().Unix() > expires {
+		return "", errors.New("ack link expired")
+	}
+	return name, nil
+}
@@ -0,0 +1,111 @@
+package ack_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tengattack/esalert/ack"
+	"github.com/tengattack/esalert/api"
+	"github.com/tengattack/esalert/config"
+	"github.com/tengattack/esalert/state"
+)
+
+func TestURL(t *testing.T) {
+	defer func() {
+		config.Opts.AckURL, config.Opts.AckSecret = "", ""
+	}()
+	_, err := ack.URL("wat")
+	assert.NotNil(t, err)
+
+	config.Opts.AckURL = "https://esalert.example.com/"
+	config.Opts.AckSecret = "s3cret"
+	config.Opts.AckLinkTTL = time.Hour
+
+	link, err := ack.URL("wat")
+	require.Nil(t, err)
+	assert.True(t, strings.HasPrefix(link, "https://esalert.example.com/ack?"), link)
+	u, err := url.Parse(link)
+	require.Nil(t, err)
+	name, err := ack.Verify(u.Query())
+	require.Nil(t, err)
+	assert.Equal(t, "wat", name)
+
+	q := u.Query()
+	q.Set("alert", "other")
+	_, err = ack.Verify(q)
+	assert.NotNil(t, err)
+
+	config.Opts.AckLinkTTL = -time.Minute
+	link, err = ack.URL("wat")
+	require.Nil(t, err)
+	u, err = url.Parse(link)
+	require.Nil(t, err)
+	_, err = ack.Verify(u.Query())
+	assert.NotNil(t, err)
+
+	// links from api requests acknowledge the alert
+	config.Opts.AckLinkTTL = time.Hour
+	state.Reset()
+	defer state.Reset()
+	link, err = ack.URL("wat")
+	require.Nil(t, err)
+	u, err = url.Parse(link)
+	require.Nil(t, err)
+
+	s := httptest.NewServer(api.Handler())
+	defer s.Close()
+	resp, err := http.Post(s.URL+u.RequestURI(), "", nil)
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// opening the link only shows a confirmation page, e.g. link previews
+	// mustn't acknowledge the alert
+	state.Update("wat", func(s *state.State) { s.Record(true, nil, time.Now()) })
+	resp, err = http.Get(s.URL + u.RequestURI())
+	require.Nil(t, err)
+	page, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(page), `<form method="post">`)
+	assert.False(t, state.Get("wat").Acknowledged)
+
+	resp, err = http.Post(s.URL+u.RequestURI(), "", nil)
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, state.Get("wat").Acknowledged)
+
+	resp, err = http.Get(s.URL + strings.Replace(u.RequestURI(), "sig=", "sig=0", 1))
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp, err = http.Post(s.URL+strings.Replace(u.RequestURI(), "sig=", "sig=0", 1), "", nil)
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// api requests must have the secret as a bearer token
+	post := func(token string) int {
+		req, err := http.NewRequest(http.MethodPost, s.URL+ack.Path, strings.NewReader(`{"alert":"wat"}`))
+		require.Nil(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusUnauthorized, post(""))
+	assert.Equal(t, http.StatusUnauthorized, post("nope"))
+	assert.Equal(t, http.StatusOK, post("s3cret"))
+}
@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"strings"
 
@@ -26,9 +27,13 @@ type Actioner interface {
 	Do(context.Context) error
 }
 
-// Action is a wrapper around an Actioner which contains some type information
+// Action is a wrapper around an Actioner which contains some type information,
+// how it should be retried, and the ordering group it belongs to. Actions in
+// the same group are performed sequentially
 type Action struct {
-	Type string
+	Type  string
+	Retry RetryPolicy
+	Group string
 	Actioner
 }
 
@@ -36,11 +41,30 @@ type Action struct {
 // looks at its "type" key, and any other fields necessary based on that type,
 // and returns an Actioner (or an error)
 func ToActioner(in interface{}) (Action, error) {
-	min, ok := in.(map[string]interface{})
+	def, ok := in.(map[string]interface{})
 	if !ok {
 		return Action{}, errors.New("action definition is not an object")
 	}
 
+	// copy the definition so the caller's is left untouched
+	min := make(map[string]interface{}, len(def))
+	for k, v := range def {
+		min[k] = v
+	}
+
+	var retry RetryPolicy
+	if r, ok := min["retry"]; ok {
+		var err error
+		if retry, err = toRetryPolicy(r); err != nil {
+			return Action{}, fmt.Errorf("parsing retry: %s", err)
+		}
+		delete(min, "retry")
+	}
+
+	group, _ := min["group"].(string)
+	delete(min, "group")
+	delete(min, "template")
+
 	var a Actioner
 	typ, _ := min["type"].(string)
 	typ = strings.ToLower(typ)
@@ -52,6 +76,20 @@ func ToActioner(in interface{}) (Action, error) {
 		a = &HTTP{}
 	case "slack":
 		a = &Slack{}
+	case "dingtalk":
+		a = &DingTalk{}
+	case "wecom":
+		a = &WeCom{}
+	case "feishu", "lark":
+		a = &Feishu{}
+	case "telegram":
+		a = &Telegram{}
+	case "elasticsearch":
+		a = &Elasticsearch{}
+	case "exec":
+		a = &Exec{}
+	case "alertmanager":
+		a = &Alertmanager{}
 	default:
 		return Action{}, fmt.Errorf("unknown action type: %q", typ)
 	}
@@ -59,7 +97,7 @@ func ToActioner(in interface{}) (Action, error) {
 	if err := mapstructure.Decode(min, a); err != nil {
 		return Action{}, err
 	}
-	return Action{Type: typ, Actioner: a}, nil
+	return Action{Type: typ, Retry: retry, Group: group, Actioner: a}, nil
 }
 
 // Log is an action which does nothing but print a log message. Useful when
@@ -77,6 +115,16 @@ func (l *Log) Do(_ context.Context) error {
 	return nil
 }
 
+// StatusError is returned by actions which perform http requests when the
+// response doesn't have a 2xx response code
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("non 2xx response code returned: %d", e.StatusCode)
+}
+
 // HTTP is an action which performs a single http request. If the request's
 // response doesn't have a 2xx response code then it's considered an error
 type HTTP struct {
@@ -106,7 +154,7 @@ func (h *HTTP) Do(_ context.Context) error {
 	resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return fmt.Errorf("non 2xx response code returned: %d", resp.StatusCode)
+		return &StatusError{StatusCode: resp.StatusCode}
 	}
 
 	return nil
@@ -127,21 +175,38 @@ func (s *Slack) Do(c context.Context) error {
 		return errors.New("missing required field text in Slack")
 	}
 
-	bodyb, err := json.Marshal(&s)
+	_, err := postJSON(config.Opts.SlackWebhook, &s)
+	return err
+}
+
+// postJSON json encodes the given body and posts it to the given url, returning
+// the response body. If the response doesn't have a 2xx response code then
+// it's considered an error
+func postJSON(u string, body interface{}) ([]byte, error) {
+	bodyb, err := json.Marshal(body)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	r, err := http.NewRequest("POST", config.Opts.SlackWebhook, bytes.NewBuffer(bodyb))
+	r, err := http.NewRequest("POST", u, bytes.NewBuffer(bodyb))
 	if err != nil {
-		return err
+		return nil, err
 	}
 	r.Header.Set("Content-Type", "application/json")
 
 	resp, err := http.DefaultClient.Do(r)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	resp.Body.Close()
-	return nil
+	defer resp.Body.Close()
+
+	respb, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &StatusError{StatusCode: resp.StatusCode}
+	}
+	return respb, nil
 }
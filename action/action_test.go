@@ -1,14 +1,25 @@
 package action_test
 
 import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/tengattack/esalert/action"
+	"github.com/tengattack/esalert/config"
 	"github.com/tengattack/esalert/context"
+	"github.com/tengattack/esalert/search"
 )
 
 func TestToActioner(t *testing.T) {
@@ -29,6 +40,123 @@ func TestToActioner(t *testing.T) {
 	a, err = action.ToActioner(m)
 	assert.Nil(t, err)
 	assert.Equal(t, &action.Slack{Text: "foo"}, a.Actioner)
+
+	m = map[string]interface{}{
+		"type":       "dingtalk",
+		"msgtype":    "markdown",
+		"text":       "foo",
+		"at_mobiles": []interface{}{"13800000000"},
+	}
+	a, err = action.ToActioner(m)
+	assert.Nil(t, err)
+	assert.Equal(t, &action.DingTalk{MsgType: "markdown", Text: "foo", AtMobiles: []string{"13800000000"}}, a.Actioner)
+
+	m = map[string]interface{}{
+		"type": "lark",
+		"text": "foo",
+	}
+	a, err = action.ToActioner(m)
+	assert.Nil(t, err)
+	assert.Equal(t, &action.Feishu{Text: "foo"}, a.Actioner)
+}
+
+func hmacSHA256Base64(key, msg string) string {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write([]byte(msg))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func TestDingTalkAction(t *testing.T) {
+	var body map[string]interface{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		ts := q.Get("timestamp")
+		if q.Get("access_token") != "token" || q.Get("sign") != hmacSHA256Base64("secret", ts+"\nsecret") {
+			w.Write([]byte(`{"errcode":310000,"errmsg":"sign not match"}`))
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Write([]byte(`{"errcode":0,"errmsg":"ok"}`))
+	}))
+	defer s.Close()
+
+	config.Opts.DingTalkWebhook = s.URL + "/robot/send?access_token=token"
+	config.Opts.DingTalkSecret = "secret"
+	defer func() {
+		config.Opts.DingTalkWebhook = ""
+		config.Opts.DingTalkSecret = ""
+	}()
+
+	d := &action.DingTalk{
+		MsgType:   "markdown",
+		Text:      "**foo**",
+		AtMobiles: []string{"13800000000"},
+	}
+	require.Nil(t, d.Do(context.Context{Name: "wat"}))
+	assert.Equal(t, "markdown", body["msgtype"])
+	assert.Equal(t, map[string]interface{}{
+		"title": "wat",
+		"text":  "**foo** @13800000000",
+	}, body["markdown"])
+	assert.Equal(t, map[string]interface{}{
+		"atMobiles": []interface{}{"13800000000"},
+	}, body["at"])
+
+	config.Opts.DingTalkSecret = "wrong"
+	require.NotNil(t, d.Do(context.Context{Name: "wat"}))
+}
+
+func TestWeComAction(t *testing.T) {
+	var body map[string]interface{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Write([]byte(`{"errcode":0,"errmsg":"ok"}`))
+	}))
+	defer s.Close()
+
+	config.Opts.WeComWebhook = s.URL
+	defer func() { config.Opts.WeComWebhook = "" }()
+
+	wc := &action.WeCom{
+		Text:      "foo",
+		AtUserIDs: []string{"bar"},
+		AtAll:     true,
+	}
+	require.Nil(t, wc.Do(context.Context{}))
+	assert.Equal(t, map[string]interface{}{
+		"msgtype": "text",
+		"text": map[string]interface{}{
+			"content":        "foo",
+			"mentioned_list": []interface{}{"bar", "@all"},
+		},
+	}, body)
+}
+
+func TestFeishuAction(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		ts, _ := body["timestamp"].(string)
+		if body["sign"] != hmacSHA256Base64(ts+"\nsecret", "") {
+			w.Write([]byte(`{"code":19021,"msg":"sign match fail or timestamp is not within one hour from current time"}`))
+			return
+		}
+		w.Write([]byte(`{"code":0,"msg":"success"}`))
+	}))
+	defer s.Close()
+
+	config.Opts.FeishuWebhook = s.URL
+	config.Opts.FeishuSecret = "secret"
+	defer func() {
+		config.Opts.FeishuWebhook = ""
+		config.Opts.FeishuSecret = ""
+	}()
+
+	f := &action.Feishu{Text: "foo"}
+	require.Nil(t, f.Do(context.Context{}))
+
+	config.Opts.FeishuSecret = "wrong"
+	require.NotNil(t, f.Do(context.Context{}))
 }
 
 func TestHTTPAction(t *testing.T) {
@@ -51,3 +179,276 @@ func TestHTTPAction(t *testing.T) {
 	h.URL = s.URL + "/bad"
 	require.NotNil(t, h.Do(context.Context{}))
 }
+
+func TestTelegramAction(t *testing.T) {
+	var body map[string]interface{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bottoken/sendMessage" {
+			w.WriteHeader(404)
+			w.Write([]byte(`{"ok":false,"error_code":404,"description":"Not Found"}`))
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Write([]byte(`{"ok":true,"result":{}}`))
+	}))
+	defer s.Close()
+
+	config.Opts.TelegramAPIURL = s.URL
+	config.Opts.TelegramBotToken = "token"
+	defer func() { config.Opts.TelegramBotToken = "" }()
+
+	tg := &action.Telegram{
+		ChatID:              -1001234567890,
+		Text:                "*" + action.EscapeMarkdownV2("foo-bar.baz") + "*",
+		ParseMode:           action.ParseModeMarkdownV2,
+		DisableNotification: true,
+	}
+	require.Nil(t, tg.Do(context.Context{}))
+	assert.Equal(t, map[string]interface{}{
+		"chat_id":              float64(-1001234567890),
+		"text":                 `*foo\-bar\.baz*`,
+		"parse_mode":           "MarkdownV2",
+		"disable_notification": true,
+	}, body)
+
+	config.Opts.TelegramBotToken = "wrong"
+	require.NotNil(t, tg.Do(context.Context{}))
+}
+
+func TestTelegramEscape(t *testing.T) {
+	assert.Equal(t, `a\_b\*c\[d\]\(e\)\~f\`+"`"+`g\>h\#i\+j\-k\=l\|m\{n\}o\.p\!q\\`,
+		action.EscapeMarkdownV2("a_b*c[d](e)~f`g>h#i+j-k=l|m{n}o.p!q\\"))
+	assert.Equal(t, `a\_b\*c\`+"`"+`d\[e]`, action.EscapeMarkdown("a_b*c`d[e]"))
+	assert.Equal(t, "&lt;b&gt;a &amp; b&lt;/b&gt;", action.EscapeHTML("<b>a & b</b>"))
+}
+
+func TestElasticsearchAction(t *testing.T) {
+	var lines []map[string]interface{}
+	var unavailable bool
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_bulk" {
+			w.WriteHeader(404)
+			return
+		}
+		if unavailable {
+			w.WriteHeader(503)
+			return
+		}
+		sc := bufio.NewScanner(r.Body)
+		var items []string
+		for sc.Scan() {
+			var line map[string]interface{}
+			json.Unmarshal(sc.Bytes(), &line)
+			if _, ok := line["index"]; ok {
+				items = append(items, `{"index":{"status":201}}`)
+			}
+			lines = append(lines, line)
+		}
+		w.Write([]byte(`{"errors":false,"items":[` + strings.Join(items, ",") + `]}`))
+	}))
+	defer s.Close()
+
+	config.Opts.ElasticSearchAddr = strings.TrimPrefix(s.URL, "http://")
+	config.Opts.ElasticSearchBulkSize = 10
+	config.Opts.ElasticSearchFlushInterval = 10 * time.Millisecond
+
+	e := &action.Elasticsearch{
+		Index:  "esalert-{{.Name}}",
+		Fields: map[string]interface{}{"foo": "bar"},
+	}
+	c := context.Context{
+		Name: "wat",
+		Time: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Result: search.Result{
+			HitInfo: search.HitInfo{
+				HitCount: 5,
+				Hits:     []search.Hit{{ID: "a"}, {ID: "b"}},
+			},
+		},
+	}
+	require.Nil(t, e.Do(c))
+	assert.Equal(t, []map[string]interface{}{
+		{"index": map[string]interface{}{"_index": "esalert-wat"}},
+		{
+			"@timestamp": "2020-01-02T03:04:05Z",
+			"alert":      "wat",
+			"hit_count":  float64(5),
+			"hit_ids":    []interface{}{"a", "b"},
+			"fields":     map[string]interface{}{"foo": "bar"},
+		},
+	}, lines)
+
+	// elasticsearch being unavailable is retried
+	unavailable = true
+	err := e.Do(c)
+	require.NotNil(t, err)
+	assert.True(t, action.RetryPolicy{}.Retryable(err))
+}
+
+func TestExecAction(t *testing.T) {
+	config.Opts.ExecAllow = []string{"sh"}
+	config.Opts.ExecEnvAllow = []string{"FOO"}
+	defer func() { config.Opts.ExecAllow, config.Opts.ExecEnvAllow = nil, nil }()
+
+	c := context.Context{Name: "wat"}
+	e := &action.Exec{
+		Command: "sh",
+		Args:    []string{"-c", `grep -q '"Name":"wat"' && test "$ESALERT_NAME" = wat && test "$FOO" = bar`},
+		Env:     map[string]string{"FOO": "bar"},
+	}
+	require.Nil(t, e.Do(c))
+
+	// e.g. LD_PRELOAD would let the action run arbitrary code
+	e.Env = map[string]string{"LD_PRELOAD": "/tmp/evil.so"}
+	require.NotNil(t, e.Do(c))
+	e.Env = nil
+
+	e.Args = []string{"-c", "exit 3"}
+	require.NotNil(t, e.Do(c))
+
+	e.Args = []string{"-c", "sleep 5"}
+	e.Timeout = "50ms"
+	start := time.Now()
+	require.NotNil(t, e.Do(c))
+	assert.True(t, time.Since(start) < 5*time.Second)
+
+	e = &action.Exec{Command: "true"}
+	require.NotNil(t, e.Do(c))
+}
+
+func TestAlertmanagerAction(t *testing.T) {
+	var alerts []map[string]interface{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/alerts" {
+			w.WriteHeader(404)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&alerts)
+	}))
+	defer s.Close()
+
+	config.Opts.AlertmanagerURL = s.URL
+	config.Opts.KibanaURL = "http://kibana/app/discover#/{{.Name}}"
+	defer func() {
+		config.Opts.AlertmanagerURL = ""
+		config.Opts.KibanaURL = ""
+	}()
+
+	a := &action.Alertmanager{
+		Labels:         map[string]string{"team": "payments"},
+		Annotations:    map[string]string{"summary": "foo"},
+		ResolveTimeout: "1h",
+	}
+	require.Nil(t, a.Do(context.Context{Name: "wat"}))
+	require.Len(t, alerts, 1)
+	assert.Equal(t, map[string]interface{}{"alertname": "wat", "team": "payments"}, alerts[0]["labels"])
+	assert.Equal(t, map[string]interface{}{"summary": "foo"}, alerts[0]["annotations"])
+	assert.Equal(t, "http://kibana/app/discover#/wat", alerts[0]["generatorURL"])
+	startsAt := alerts[0]["startsAt"]
+
+	// while firing the same startsAt is sent
+	time.Sleep(10 * time.Millisecond)
+	require.Nil(t, a.Do(context.Context{Name: "wat"}))
+	require.Len(t, alerts, 1)
+	assert.Equal(t, startsAt, alerts[0]["startsAt"])
+	assert.NotEqual(t, startsAt, alerts[0]["endsAt"])
+}
+
+func TestRetryPolicy(t *testing.T) {
+	a, err := action.ToActioner(map[string]interface{}{
+		"type":    "log",
+		"message": "foo",
+		"retry": map[string]interface{}{
+			"max_attempts": 3,
+			"backoff":      "2s",
+			"retry_on":     []interface{}{503},
+		},
+	})
+	require.Nil(t, err)
+	assert.Equal(t, action.RetryPolicy{
+		MaxAttempts: 3,
+		Backoff:     2 * time.Second,
+		MaxBackoff:  action.DefaultRetryMaxBackoff,
+		RetryOn:     []int{503},
+	}, a.Retry)
+	assert.Equal(t, &action.Log{Message: "foo", Fields: map[string]interface{}{"message": "foo"}}, a.Actioner)
+
+	assert.True(t, a.Retry.Retryable(&action.StatusError{StatusCode: 503}))
+	assert.False(t, a.Retry.Retryable(&action.StatusError{StatusCode: 502}))
+	assert.True(t, a.Retry.Retryable(&net.OpError{Op: "dial", Err: errors.New("connection refused")}))
+	assert.False(t, a.Retry.Retryable(assert.AnError))
+	assert.True(t, action.RetryPolicy{}.Retryable(&search.StatusError{StatusCode: 429}))
+	assert.False(t, action.RetryPolicy{}.Retryable(&search.StatusError{StatusCode: 400}))
+	assert.True(t, action.RetryPolicy{}.Retryable(&action.StatusError{StatusCode: 429}))
+	assert.False(t, action.RetryPolicy{}.Retryable(&action.StatusError{StatusCode: 404}))
+
+	assert.Equal(t, time.Duration(0), a.Retry.Wait(1))
+	for attempt, max := range map[int]time.Duration{2: 2 * time.Second, 3: 4 * time.Second, 10: time.Minute} {
+		w := a.Retry.Wait(attempt)
+		assert.True(t, w >= max/2 && w <= max, "attempt %d waits %s", attempt, w)
+	}
+}
+
+func TestRunLimited(t *testing.T) {
+	var attempts int
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(503)
+	}))
+	defer s.Close()
+
+	a, err := action.ToActioner(map[string]interface{}{
+		"type":   "http",
+		"method": "GET",
+		"url":    s.URL,
+		"retry":  map[string]interface{}{"max_attempts": 3, "backoff": "1ms"},
+	})
+	require.Nil(t, err)
+
+	// the limit is only held during attempts, not while waiting between them
+	var acquired, held int
+	err = a.RunLimited(context.Context{}, func() func() {
+		acquired++
+		held++
+		return func() { held-- }
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, 3, acquired)
+	assert.Equal(t, 0, held)
+}
+
+func TestRender(t *testing.T) {
+	c := context.Context{
+		Name: "wat",
+		Result: search.Result{
+			HitInfo: search.HitInfo{
+				HitCount: 5,
+				Hits:     []search.Hit{{ID: "a_b"}},
+			},
+		},
+	}
+	m := map[string]interface{}{
+		"type":     "http",
+		"template": true,
+		"url":      "http://example.com/{{.Name}}",
+		"headers":  map[string]interface{}{"X-Count": "{{.HitCount}}"},
+		"body":     `{{.HitCount}} errors in {{.Name}}, first {{(index .Hits 0).ID | escapeMarkdownV2}}`,
+	}
+	assert.True(t, action.Templated(m))
+	r, err := action.Render(m, c)
+	require.Nil(t, err)
+	assert.Equal(t, "http://example.com/{{.Name}}", m["url"], "input is left untouched")
+
+	a, err := action.ToActioner(r)
+	require.Nil(t, err)
+	assert.Equal(t, &action.HTTP{
+		URL:     "http://example.com/wat",
+		Headers: map[string]string{"X-Count": "5"},
+		Body:    `5 errors in wat, first a\_b`,
+	}, a.Actioner)
+
+	_, err = action.Render(map[string]interface{}{"text": "{{.Nope}}"}, c)
+	assert.NotNil(t, err)
+	assert.False(t, action.Templated(map[string]interface{}{"text": "{{.Name}}"}))
+}
@@ -0,0 +1,117 @@
+package action
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/tengattack/esalert/config"
+	"github.com/tengattack/esalert/context"
+)
+
+// Alertmanager posts an alert to a Prometheus Alertmanager, so that its
+// routing, silencing and grouping can be used. The alert's endsAt is set
+// resolve_timeout into the future, so as long as the action keeps being
+// performed at a shorter interval Alertmanager considers the alert firing
+type Alertmanager struct {
+	Labels       map[string]string `mapstructure:"labels"`
+	Annotations  map[string]string `mapstructure:"annotations"`
+	GeneratorURL string            `mapstructure:"generator_url"`
+	// ResolveTimeout is a duration string (e.g. "10m"), defaults to the
+	// alertmanager-resolve-timeout runtime config
+	ResolveTimeout string `mapstructure:"resolve_timeout"`
+}
+
+type alertmanagerAlert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+}
+
+// alertmanagerFiring keeps track of when the alerts sent to Alertmanager
+// started firing, keyed by their label set, so the same startsAt is sent
+// while they keep firing
+var alertmanagerFiring = struct {
+	sync.Mutex
+	m map[string]alertmanagerAlert
+}{m: map[string]alertmanagerAlert{}}
+
+func labelsKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%q=%q,", k, labels[k])
+	}
+	return b.String()
+}
+
+// Do performs the actual request to the Alertmanager api
+func (a *Alertmanager) Do(c context.Context) error {
+	if config.Opts.AlertmanagerURL == "" {
+		return errors.New("Alertmanager url not set in config")
+	}
+
+	resolveTimeout := config.Opts.AlertmanagerResolveTimeout
+	if a.ResolveTimeout != "" {
+		var err error
+		if resolveTimeout, err = time.ParseDuration(a.ResolveTimeout); err != nil {
+			return fmt.Errorf("parsing resolve_timeout: %s", err)
+		}
+	}
+
+	labels := map[string]string{"alertname": c.Name}
+	for k, v := range a.Labels {
+		labels[k] = v
+	}
+
+	generatorURL := a.GeneratorURL
+	if generatorURL == "" && config.Opts.KibanaURL != "" {
+		tpl, err := template.New("").Parse(config.Opts.KibanaURL)
+		if err != nil {
+			return err
+		}
+		buf := bytes.NewBuffer(make([]byte, 0, 128))
+		if err := tpl.Execute(buf, &c); err != nil {
+			return err
+		}
+		generatorURL = buf.String()
+	}
+
+	now := time.Now()
+	key := labelsKey(labels)
+	alertmanagerFiring.Lock()
+	for k, prev := range alertmanagerFiring.m {
+		if k != key && now.After(prev.EndsAt) {
+			delete(alertmanagerFiring.m, k)
+		}
+	}
+	startsAt := now
+	if prev, ok := alertmanagerFiring.m[key]; ok && now.Before(prev.EndsAt) {
+		startsAt = prev.StartsAt
+	}
+	alert := alertmanagerAlert{
+		Labels:       labels,
+		Annotations:  a.Annotations,
+		StartsAt:     startsAt,
+		EndsAt:       now.Add(resolveTimeout),
+		GeneratorURL: generatorURL,
+	}
+	alertmanagerFiring.m[key] = alert
+	alertmanagerFiring.Unlock()
+
+	u := strings.TrimRight(config.Opts.AlertmanagerURL, "/") + "/api/v2/alerts"
+	_, err := postJSON(u, []alertmanagerAlert{alert})
+	return err
+}
@@ -0,0 +1,144 @@
+package action
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tengattack/esalert/config"
+	"github.com/tengattack/esalert/context"
+)
+
+// Message types supported by the robot actions
+const (
+	MsgTypeText     = "text"
+	MsgTypeMarkdown = "markdown"
+)
+
+// DingTalk sends a message to a DingTalk group through a custom robot
+type DingTalk struct {
+	MsgType   string   `mapstructure:"msgtype"`
+	Title     string   `mapstructure:"title"`
+	Text      string   `mapstructure:"text"`
+	AtMobiles []string `mapstructure:"at_mobiles"`
+	AtUserIDs []string `mapstructure:"at_user_ids"`
+	AtAll     bool     `mapstructure:"at_all"`
+}
+
+type dingTalkAt struct {
+	AtMobiles []string `json:"atMobiles,omitempty"`
+	AtUserIDs []string `json:"atUserIds,omitempty"`
+	IsAtAll   bool     `json:"isAtAll,omitempty"`
+}
+
+type dingTalkText struct {
+	Content string `json:"content"`
+}
+
+type dingTalkMarkdown struct {
+	Title string `json:"title"`
+	Text  string `json:"text"`
+}
+
+type dingTalkMessage struct {
+	MsgType  string            `json:"msgtype"`
+	Text     *dingTalkText     `json:"text,omitempty"`
+	Markdown *dingTalkMarkdown `json:"markdown,omitempty"`
+	At       dingTalkAt        `json:"at"`
+}
+
+// robotResponse is the response body returned by the DingTalk and WeCom
+// robot apis
+type robotResponse struct {
+	ErrCode int    `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
+}
+
+// Do performs the actual request to the DingTalk robot api
+func (d *DingTalk) Do(c context.Context) error {
+	if config.Opts.DingTalkWebhook == "" {
+		return errors.New("DingTalk webhook not set in config")
+	}
+
+	if d.Text == "" {
+		return errors.New("missing required field text in DingTalk")
+	}
+
+	msg := dingTalkMessage{
+		At: dingTalkAt{
+			AtMobiles: d.AtMobiles,
+			AtUserIDs: d.AtUserIDs,
+			IsAtAll:   d.AtAll,
+		},
+	}
+	switch d.MsgType {
+	case "", MsgTypeText:
+		msg.MsgType = MsgTypeText
+		msg.Text = &dingTalkText{Content: d.Text}
+	case MsgTypeMarkdown:
+		title := d.Title
+		if title == "" {
+			title = c.Name
+		}
+		// mentions are only highlighted in markdown messages if they appear
+		// in the text itself
+		text := d.Text
+		for _, m := range d.AtMobiles {
+			if !strings.Contains(text, "@"+m) {
+				text += " @" + m
+			}
+		}
+		for _, id := range d.AtUserIDs {
+			if !strings.Contains(text, "@"+id) {
+				text += " @" + id
+			}
+		}
+		msg.MsgType = MsgTypeMarkdown
+		msg.Markdown = &dingTalkMarkdown{Title: title, Text: text}
+	default:
+		return fmt.Errorf("unknown msgtype in DingTalk: %q", d.MsgType)
+	}
+
+	u := config.Opts.DingTalkWebhook
+	if config.Opts.DingTalkSecret != "" {
+		ts := strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+		sign := hmacSHA256Base64(config.Opts.DingTalkSecret, ts+"\n"+config.Opts.DingTalkSecret)
+		sep := "?"
+		if strings.Contains(u, "?") {
+			sep = "&"
+		}
+		u += sep + "timestamp=" + ts + "&sign=" + url.QueryEscape(sign)
+	}
+
+	respb, err := postJSON(u, &msg)
+	if err != nil {
+		return err
+	}
+	return checkRobotResponse(respb)
+}
+
+func checkRobotResponse(respb []byte) error {
+	var resp robotResponse
+	if err := json.Unmarshal(respb, &resp); err != nil {
+		return err
+	}
+	if resp.ErrCode != 0 {
+		return fmt.Errorf("robot api error %d: %s", resp.ErrCode, resp.ErrMsg)
+	}
+	return nil
+}
+
+// hmacSHA256Base64 returns the base64 encoded HMAC-SHA256 of msg using the
+// given key
+func hmacSHA256Base64(key, msg string) string {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write([]byte(msg))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,143 @@
+package action
+
+import (
+	"bytes"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/tengattack/esalert/config"
+	"github.com/tengattack/esalert/context"
+	"github.com/tengattack/esalert/search"
+)
+
+// Elasticsearch writes a document describing the alert event back into
+// elasticsearch, using the same instance and credentials as the search step.
+// Documents from actions performed around the same time are batched together
+// into bulk requests
+type Elasticsearch struct {
+	// Index may be a go template, it's executed against the alert context.
+	// Defaults to the es-alert-index runtime config
+	Index   string                 `mapstructure:"index"`
+	DocType string                 `mapstructure:"doc_type"`
+	HitIDs  []string               `mapstructure:"hit_ids"`
+	Fields  map[string]interface{} `mapstructure:"fields"`
+}
+
+// alertEvent is the document written by the Elasticsearch action
+type alertEvent struct {
+	Timestamp time.Time              `json:"@timestamp"`
+	Alert     string                 `json:"alert"`
+	HitCount  uint64                 `json:"hit_count"`
+	HitIDs    []string               `json:"hit_ids"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+}
+
+// Do renders the index and queues the document to be written by the next bulk
+// request, waiting for that request to complete
+func (e *Elasticsearch) Do(c context.Context) error {
+	index := e.Index
+	if index == "" {
+		index = config.Opts.ElasticSearchIndex
+	}
+	tpl, err := template.New("").Parse(index)
+	if err != nil {
+		return err
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 64))
+	if err := tpl.Execute(buf, &c); err != nil {
+		return err
+	}
+
+	hitIDs := e.HitIDs
+	if hitIDs == nil {
+		// default to all the hits the search returned
+		hitIDs = make([]string, len(c.Hits))
+		for i := range c.Hits {
+			hitIDs[i] = c.Hits[i].ID
+		}
+	}
+
+	ts := c.Time
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+
+	item := search.BulkItem{
+		Index: buf.String(),
+		Type:  e.DocType,
+		Doc: &alertEvent{
+			Timestamp: ts,
+			Alert:     c.Name,
+			HitCount:  c.HitCount,
+			HitIDs:    hitIDs,
+			Fields:    e.Fields,
+		},
+	}
+	return defaultBulkIndexer().index(item)
+}
+
+type bulkReq struct {
+	item  search.BulkItem
+	errCh chan error
+}
+
+// bulkIndexer collects documents from concurrently performed Elasticsearch
+// actions, and writes them in batches of up to es-bulk-size documents,
+// waiting at most es-flush-interval for a batch to fill up
+type bulkIndexer struct {
+	reqCh chan bulkReq
+}
+
+var (
+	bulkIndexerOnce sync.Once
+	bulkIndexerInst *bulkIndexer
+)
+
+func defaultBulkIndexer() *bulkIndexer {
+	bulkIndexerOnce.Do(func() {
+		bulkIndexerInst = &bulkIndexer{reqCh: make(chan bulkReq)}
+		go bulkIndexerInst.spin()
+	})
+	return bulkIndexerInst
+}
+
+func (b *bulkIndexer) index(item search.BulkItem) error {
+	req := bulkReq{item: item, errCh: make(chan error, 1)}
+	b.reqCh <- req
+	return <-req.errCh
+}
+
+func (b *bulkIndexer) spin() {
+	for req := range b.reqCh {
+		batch := []bulkReq{req}
+		timer := time.NewTimer(config.Opts.ElasticSearchFlushInterval)
+	collect:
+		for len(batch) < config.Opts.ElasticSearchBulkSize {
+			select {
+			case req := <-b.reqCh:
+				batch = append(batch, req)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+		b.flush(batch)
+	}
+}
+
+func (b *bulkIndexer) flush(batch []bulkReq) {
+	items := make([]search.BulkItem, len(batch))
+	for i := range batch {
+		items[i] = batch[i].item
+	}
+
+	errs, err := search.Bulk(items)
+	for i := range batch {
+		if err != nil {
+			batch[i].errCh <- err
+		} else {
+			batch[i].errCh <- errs[i]
+		}
+	}
+}
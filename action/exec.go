@@ -0,0 +1,147 @@
+package action
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tengattack/esalert/config"
+	"github.com/tengattack/esalert/context"
+	"github.com/tengattack/tgo/log"
+)
+
+// Exec runs a local command. The alert context is passed to the command as
+// json on its stdin, and as ESALERT_* environment variables. Only commands in
+// the exec-allow runtime config may be run, and only variables in the
+// exec-env-allow runtime config may be set by Env. If the command exits with a
+// non zero code then it's considered an error
+type Exec struct {
+	Command string            `mapstructure:"command"`
+	Args    []string          `mapstructure:"args"`
+	Env     map[string]string `mapstructure:"env"`
+	// Timeout is a duration string (e.g. "10s"), defaults to the exec-timeout
+	// runtime config
+	Timeout string `mapstructure:"timeout"`
+}
+
+// execAllowed returns whether the given command is in the allow-list, either
+// as is or after both have been resolved through PATH
+func execAllowed(command string) bool {
+	resolved, err := exec.LookPath(command)
+	if err != nil {
+		resolved = ""
+	}
+	for _, allowed := range config.Opts.ExecAllow {
+		if allowed == command {
+			return true
+		}
+		if resolved == "" {
+			continue
+		}
+		if p, err := exec.LookPath(allowed); err == nil && p == resolved {
+			return true
+		}
+	}
+	return false
+}
+
+// execEnvAllowed returns whether the given environment variable is in the
+// allow-list
+func execEnvAllowed(name string) bool {
+	for _, allowed := range config.Opts.ExecEnvAllow {
+		if allowed == name {
+			return true
+		}
+	}
+	return false
+}
+
+func execEnv(c context.Context) []string {
+	return []string{
+		"ESALERT_NAME=" + c.Name,
+		"ESALERT_STARTED_TS=" + strconv.FormatUint(c.StartedTS, 10),
+		"ESALERT_TIME=" + c.Time.Format(time.RFC3339),
+		"ESALERT_TOOK_MS=" + strconv.FormatUint(c.TookMS, 10),
+		"ESALERT_HIT_COUNT=" + strconv.FormatUint(c.HitCount, 10),
+		"ESALERT_HIT_MAX_SCORE=" + strconv.FormatFloat(c.HitMaxScore, 'f', -1, 64),
+	}
+}
+
+// Do runs the command and waits for it to exit, or kills it once the timeout
+// is reached
+func (e *Exec) Do(c context.Context) error {
+	if e.Command == "" {
+		return errors.New("missing required field command in Exec")
+	}
+	if !execAllowed(e.Command) {
+		return fmt.Errorf("command not allowed by exec-allow: %q", e.Command)
+	}
+	for k := range e.Env {
+		if !execEnvAllowed(k) {
+			return fmt.Errorf("env not allowed by exec-env-allow: %q", k)
+		}
+	}
+
+	timeout := config.Opts.ExecTimeout
+	if e.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(e.Timeout); err != nil {
+			return fmt.Errorf("parsing timeout: %s", err)
+		}
+	}
+
+	stdin, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(e.Command, e.Args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.Env = append(os.Environ(), execEnv(c)...)
+	for k, v := range e.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+
+	setProcessGroup(cmd)
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	var timer *time.Timer
+	if timeout > 0 {
+		timer = time.AfterFunc(timeout, func() {
+			killProcess(cmd)
+		})
+	}
+	err = cmd.Wait()
+	// if the timer can't be stopped anymore it has already killed the command
+	timedOut := timer != nil && !timer.Stop()
+
+	kv := logrus.Fields{
+		"command": e.Command,
+		"args":    e.Args,
+		"stdout":  strings.TrimSpace(stdout.String()),
+		"stderr":  strings.TrimSpace(stderr.String()),
+	}
+	if err != nil {
+		kv["err"] = err
+		log.LogError.WithFields(kv).Errorln("exec command failed")
+		if timedOut {
+			return fmt.Errorf("command timed out after %s", timeout)
+		}
+		return err
+	}
+	log.LogAccess.WithFields(kv).Infoln("exec command completed")
+	return nil
+}
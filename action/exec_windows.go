@@ -0,0 +1,9 @@
+package action
+
+import "os/exec"
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func killProcess(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
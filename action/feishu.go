@@ -0,0 +1,110 @@
+package action
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/tengattack/esalert/config"
+	"github.com/tengattack/esalert/context"
+)
+
+// Feishu sends a message to a Feishu (Lark) group through a custom bot.
+// Markdown messages are sent as an interactive card
+type Feishu struct {
+	MsgType   string   `mapstructure:"msgtype"`
+	Title     string   `mapstructure:"title"`
+	Text      string   `mapstructure:"text"`
+	AtUserIDs []string `mapstructure:"at_user_ids"`
+	AtAll     bool     `mapstructure:"at_all"`
+}
+
+type feishuMessage struct {
+	Timestamp string      `json:"timestamp,omitempty"`
+	Sign      string      `json:"sign,omitempty"`
+	MsgType   string      `json:"msg_type"`
+	Content   interface{} `json:"content,omitempty"`
+	Card      interface{} `json:"card,omitempty"`
+}
+
+type feishuResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+// Do performs the actual request to the Feishu bot api
+func (f *Feishu) Do(c context.Context) error {
+	if config.Opts.FeishuWebhook == "" {
+		return errors.New("Feishu webhook not set in config")
+	}
+
+	if f.Text == "" {
+		return errors.New("missing required field text in Feishu")
+	}
+
+	var msg feishuMessage
+	switch f.MsgType {
+	case "", MsgTypeText:
+		text := f.Text
+		for _, id := range f.AtUserIDs {
+			text += fmt.Sprintf(` <at user_id="%s"></at>`, id)
+		}
+		if f.AtAll {
+			text += ` <at user_id="all"></at>`
+		}
+		msg.MsgType = MsgTypeText
+		msg.Content = map[string]string{"text": text}
+	case MsgTypeMarkdown:
+		title := f.Title
+		if title == "" {
+			title = c.Name
+		}
+		text := f.Text
+		for _, id := range f.AtUserIDs {
+			text += fmt.Sprintf(" <at id=%s></at>", id)
+		}
+		if f.AtAll {
+			text += " <at id=all></at>"
+		}
+		msg.MsgType = "interactive"
+		msg.Card = map[string]interface{}{
+			"header": map[string]interface{}{
+				"title": map[string]string{
+					"tag":     "plain_text",
+					"content": title,
+				},
+			},
+			"elements": []interface{}{
+				map[string]string{
+					"tag":     "markdown",
+					"content": text,
+				},
+			},
+		}
+	default:
+		return fmt.Errorf("unknown msgtype in Feishu: %q", f.MsgType)
+	}
+
+	if config.Opts.FeishuSecret != "" {
+		msg.Timestamp = strconv.FormatInt(time.Now().Unix(), 10)
+		// Feishu uses the string to sign as the key, and signs an empty
+		// message with it
+		msg.Sign = hmacSHA256Base64(msg.Timestamp+"\n"+config.Opts.FeishuSecret, "")
+	}
+
+	respb, err := postJSON(config.Opts.FeishuWebhook, &msg)
+	if err != nil {
+		return err
+	}
+
+	var resp feishuResponse
+	if err := json.Unmarshal(respb, &resp); err != nil {
+		return err
+	}
+	if resp.Code != 0 {
+		return fmt.Errorf("Feishu api error %d: %s", resp.Code, resp.Msg)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package action
+
+import (
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/sirupsen/logrus"
+	"github.com/tengattack/esalert/context"
+	"github.com/tengattack/esalert/search"
+	"github.com/tengattack/tgo/log"
+)
+
+// Defaults used for the fields of a RetryPolicy which aren't set
+const (
+	DefaultRetryBackoff    = time.Second
+	DefaultRetryMaxBackoff = time.Minute
+)
+
+// RetryPolicy describes how many times, and how often, an action is attempted
+// before it's considered failed. The zero value attempts an action only once
+type RetryPolicy struct {
+	MaxAttempts int
+	// Backoff is how long to wait before the first retry, it's doubled after
+	// every further attempt up to MaxBackoff. The actual wait is randomly
+	// jittered between half and all of it
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// RetryOn lists the http response codes which are retried. If empty 429
+	// and all 5xx response codes are. Transport errors (e.g. connection errors
+	// and timeouts) are always retried, any other error never is
+	RetryOn []int
+}
+
+func toRetryPolicy(in interface{}) (RetryPolicy, error) {
+	var raw struct {
+		MaxAttempts int    `mapstructure:"max_attempts"`
+		Backoff     string `mapstructure:"backoff"`
+		MaxBackoff  string `mapstructure:"max_backoff"`
+		RetryOn     []int  `mapstructure:"retry_on"`
+	}
+	if err := mapstructure.Decode(in, &raw); err != nil {
+		return RetryPolicy{}, err
+	}
+
+	r := RetryPolicy{
+		MaxAttempts: raw.MaxAttempts,
+		Backoff:     DefaultRetryBackoff,
+		MaxBackoff:  DefaultRetryMaxBackoff,
+		RetryOn:     raw.RetryOn,
+	}
+	var err error
+	if raw.Backoff != "" {
+		if r.Backoff, err = time.ParseDuration(raw.Backoff); err != nil {
+			return RetryPolicy{}, err
+		}
+	}
+	if raw.MaxBackoff != "" {
+		if r.MaxBackoff, err = time.ParseDuration(raw.MaxBackoff); err != nil {
+			return RetryPolicy{}, err
+		}
+	}
+	return r, nil
+}
+
+// Retryable returns whether the given error returned by an action should be
+// retried according to the policy
+func (r RetryPolicy) Retryable(err error) bool {
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	var code int
+	switch se := err.(type) {
+	case *StatusError:
+		code = se.StatusCode
+	case *search.StatusError:
+		// returned by the elasticsearch action
+		code = se.StatusCode
+	default:
+		return false
+	}
+	if len(r.RetryOn) == 0 {
+		return code == 429 || (code >= 500 && code <= 599)
+	}
+	for _, c := range r.RetryOn {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Wait returns how long to wait before the given attempt (the first attempt
+// being 1) is made
+func (r RetryPolicy) Wait(attempt int) time.Duration {
+	if attempt <= 1 || r.Backoff <= 0 {
+		return 0
+	}
+	d := r.Backoff
+	for i := 2; i < attempt && (r.MaxBackoff <= 0 || d < r.MaxBackoff); i++ {
+		d *= 2
+	}
+	if r.MaxBackoff > 0 && d > r.MaxBackoff {
+		d = r.MaxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Run performs the action, retrying it according to its RetryPolicy, and
+// returns the error of the last attempt if none of them succeeded
+func (a Action) Run(c context.Context) error {
+	return a.RunLimited(c, nil)
+}
+
+// RunLimited is like Run, but calls acquire (if not nil) before every attempt
+// and the function it returns once the attempt is done. This way concurrency
+// limits aren't held while waiting between attempts
+func (a Action) RunLimited(c context.Context, acquire func() func()) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		time.Sleep(a.Retry.Wait(attempt))
+		if acquire != nil {
+			release := acquire()
+			err = a.Do(c)
+			release()
+		} else {
+			err = a.Do(c)
+		}
+		if err == nil {
+			return nil
+		}
+		if attempt >= a.Retry.MaxAttempts || !a.Retry.Retryable(err) {
+			return err
+		}
+		log.LogError.WithFields(logrus.Fields{
+			"name":    c.Name,
+			"action":  a.Type,
+			"attempt": attempt,
+			"err":     err,
+		}).Warnln("action attempt failed, retrying")
+	}
+}
@@ -0,0 +1,140 @@
+package action
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/tengattack/esalert/config"
+	"github.com/tengattack/esalert/context"
+)
+
+// Parse modes supported by the Telegram Bot API
+const (
+	ParseModeMarkdownV2 = "MarkdownV2"
+	ParseModeMarkdown   = "Markdown"
+	ParseModeHTML       = "HTML"
+)
+
+var (
+	markdownV2Replacer = strings.NewReplacer(
+		`\`, `\\`, "_", `\_`, "*", `\*`, "[", `\[`, "]", `\]`, "(", `\(`,
+		")", `\)`, "~", `\~`, "`", "\\`", ">", `\>`, "#", `\#`, "+", `\+`,
+		"-", `\-`, "=", `\=`, "|", `\|`, "{", `\{`, "}", `\}`, ".", `\.`,
+		"!", `\!`,
+	)
+	markdownReplacer = strings.NewReplacer(
+		"_", `\_`, "*", `\*`, "`", "\\`", "[", `\[`,
+	)
+)
+
+// EscapeMarkdownV2 escapes all the characters which have a special meaning in
+// Telegram's MarkdownV2 parse mode
+func EscapeMarkdownV2(s string) string {
+	return markdownV2Replacer.Replace(s)
+}
+
+// EscapeMarkdown escapes all the characters which have a special meaning in
+// Telegram's legacy Markdown parse mode
+func EscapeMarkdown(s string) string {
+	return markdownReplacer.Replace(s)
+}
+
+// EscapeHTML escapes all the characters which have a special meaning in
+// Telegram's HTML parse mode
+func EscapeHTML(s string) string {
+	return html.EscapeString(s)
+}
+
+// Telegram sends a message to a Telegram chat through the Bot API
+type Telegram struct {
+	// ChatID may either be a number or a string (e.g. "@channelusername")
+	ChatID              interface{} `mapstructure:"chat_id"`
+	Text                string      `mapstructure:"text"`
+	ParseMode           string      `mapstructure:"parse_mode"`
+	DisableNotification bool        `mapstructure:"disable_notification"`
+}
+
+type telegramMessage struct {
+	ChatID              interface{} `json:"chat_id"`
+	Text                string      `json:"text"`
+	ParseMode           string      `json:"parse_mode,omitempty"`
+	DisableNotification bool        `json:"disable_notification,omitempty"`
+}
+
+type telegramResponse struct {
+	OK          bool   `json:"ok"`
+	ErrorCode   int    `json:"error_code"`
+	Description string `json:"description"`
+}
+
+// Do performs the actual sendMessage request to the Telegram Bot API
+func (t *Telegram) Do(_ context.Context) error {
+	if config.Opts.TelegramBotToken == "" {
+		return errors.New("Telegram bot token not set in config")
+	}
+
+	if t.ChatID == nil || t.ChatID == "" {
+		return errors.New("missing required field chat_id in Telegram")
+	}
+	if t.Text == "" {
+		return errors.New("missing required field text in Telegram")
+	}
+
+	switch t.ParseMode {
+	case "", ParseModeMarkdownV2, ParseModeMarkdown, ParseModeHTML:
+	default:
+		return fmt.Errorf("unknown parse_mode in Telegram: %q", t.ParseMode)
+	}
+
+	bodyb, err := json.Marshal(&telegramMessage{
+		ChatID:              t.ChatID,
+		Text:                t.Text,
+		ParseMode:           t.ParseMode,
+		DisableNotification: t.DisableNotification,
+	})
+	if err != nil {
+		return err
+	}
+
+	apiURL := strings.TrimRight(config.Opts.TelegramAPIURL, "/")
+	if apiURL == "" {
+		apiURL = "https://api.telegram.org"
+	}
+	u := fmt.Sprintf("%s/bot%s/sendMessage", apiURL, config.Opts.TelegramBotToken)
+	r, err := http.NewRequest("POST", u, bytes.NewBuffer(bodyb))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respb, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	// the Bot API describes what went wrong in the body even for non 2xx
+	// responses, so try to make use of it
+	var tr telegramResponse
+	if err := json.Unmarshal(respb, &tr); err != nil {
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return &StatusError{StatusCode: resp.StatusCode}
+		}
+		return err
+	}
+	if !tr.OK {
+		return fmt.Errorf("Telegram api error %d: %s", tr.ErrorCode, tr.Description)
+	}
+	return nil
+}
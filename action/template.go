@@ -0,0 +1,102 @@
+package action
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/tengattack/esalert/ack"
+	"github.com/tengattack/esalert/context"
+)
+
+// TemplateFuncs are the functions available in templates rendered by Render,
+// in addition to the go template builtins
+var TemplateFuncs = template.FuncMap{
+	"escapeMarkdownV2": EscapeMarkdownV2,
+	"escapeMarkdown":   EscapeMarkdown,
+	"escapeHTML":       EscapeHTML,
+	"ackURL":           ack.URL,
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// Templated returns whether the given raw action definition asks for its
+// fields to be rendered as go templates, by having its "template" field set
+// to true
+func Templated(in interface{}) bool {
+	def, ok := in.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	tpl, _ := def["template"].(bool)
+	return tpl
+}
+
+// Render takes in a raw action definition, and returns a copy of it with all
+// of its string fields (including those nested in objects and arrays, e.g. the
+// headers of an http action) executed as go templates against the given
+// context. The "type" and "template" fields are left as is
+func Render(in interface{}, c context.Context) (interface{}, error) {
+	def, ok := in.(map[string]interface{})
+	if !ok {
+		return in, nil
+	}
+
+	out := make(map[string]interface{}, len(def))
+	for k, v := range def {
+		if k == "type" || k == "template" {
+			out[k] = v
+			continue
+		}
+		rv, err := renderValue(v, &c)
+		if err != nil {
+			return nil, fmt.Errorf("rendering %s: %s", k, err)
+		}
+		out[k] = rv
+	}
+	return out, nil
+}
+
+func renderValue(v interface{}, c *context.Context) (interface{}, error) {
+	switch vv := v.(type) {
+	case string:
+		if !strings.Contains(vv, "{{") {
+			return vv, nil
+		}
+		tpl, err := template.New("").Funcs(TemplateFuncs).Parse(vv)
+		if err != nil {
+			return nil, err
+		}
+		buf := bytes.NewBuffer(make([]byte, 0, len(vv)))
+		if err := tpl.Execute(buf, c); err != nil {
+			return nil, err
+		}
+		return buf.String(), nil
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(vv))
+		for k, vi := range vv {
+			rv, err := renderValue(vi, c)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = rv
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, len(vv))
+		for i := range vv {
+			rv, err := renderValue(vv[i], c)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = rv
+		}
+		return out, nil
+	default:
+		return v, nil
+	}
+}
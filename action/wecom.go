@@ -0,0 +1,79 @@
+package action
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/tengattack/esalert/config"
+	"github.com/tengattack/esalert/context"
+)
+
+// WeCom sends a message to a WeCom (Enterprise WeChat) group through a group
+// robot
+type WeCom struct {
+	MsgType   string   `mapstructure:"msgtype"`
+	Text      string   `mapstructure:"text"`
+	AtMobiles []string `mapstructure:"at_mobiles"`
+	AtUserIDs []string `mapstructure:"at_user_ids"`
+	AtAll     bool     `mapstructure:"at_all"`
+}
+
+type weComText struct {
+	Content             string   `json:"content"`
+	MentionedList       []string `json:"mentioned_list,omitempty"`
+	MentionedMobileList []string `json:"mentioned_mobile_list,omitempty"`
+}
+
+type weComMarkdown struct {
+	Content string `json:"content"`
+}
+
+type weComMessage struct {
+	MsgType  string         `json:"msgtype"`
+	Text     *weComText     `json:"text,omitempty"`
+	Markdown *weComMarkdown `json:"markdown,omitempty"`
+}
+
+// Do performs the actual request to the WeCom robot api
+func (w *WeCom) Do(_ context.Context) error {
+	if config.Opts.WeComWebhook == "" {
+		return errors.New("WeCom webhook not set in config")
+	}
+
+	if w.Text == "" {
+		return errors.New("missing required field text in WeCom")
+	}
+
+	var msg weComMessage
+	switch w.MsgType {
+	case "", MsgTypeText:
+		userIDs := w.AtUserIDs
+		if w.AtAll {
+			userIDs = append(userIDs, "@all")
+		}
+		msg.MsgType = MsgTypeText
+		msg.Text = &weComText{
+			Content:             w.Text,
+			MentionedList:       userIDs,
+			MentionedMobileList: w.AtMobiles,
+		}
+	case MsgTypeMarkdown:
+		// markdown messages don't support the mentioned lists, users have to
+		// be mentioned in the content instead. Mobiles can't be mentioned at
+		// all
+		content := w.Text
+		for _, id := range w.AtUserIDs {
+			content += " <@" + id + ">"
+		}
+		msg.MsgType = MsgTypeMarkdown
+		msg.Markdown = &weComMarkdown{Content: content}
+	default:
+		return fmt.Errorf("unknown msgtype in WeCom: %q", w.MsgType)
+	}
+
+	respb, err := postJSON(config.Opts.WeComWebhook, &msg)
+	if err != nil {
+		return err
+	}
+	return checkRobotResponse(respb)
+}
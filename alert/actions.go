@@ -0,0 +1,149 @@
+package alert
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tengattack/esalert/action"
+	"github.com/tengattack/esalert/config"
+	"github.com/tengattack/esalert/context"
+	"github.com/tengattack/esalert/queue"
+	"github.com/tengattack/tgo/log"
+)
+
+var (
+	globalSemOnce sync.Once
+	globalSem     chan struct{}
+)
+
+// acquireGlobal blocks until one of the action-concurrency slots shared by all
+// alerts is free, and returns a function releasing it
+func acquireGlobal() func() {
+	globalSemOnce.Do(func() {
+		if config.Opts.ActionConcurrency > 0 {
+			globalSem = make(chan struct{}, config.Opts.ActionConcurrency)
+		}
+	})
+	if globalSem == nil {
+		return func() {}
+	}
+	globalSem <- struct{}{}
+	return func() { <-globalSem }
+}
+
+type indexedAction struct {
+	index int
+	action.Action
+}
+
+// performActions renders (if they ask to be), unpacks and performs all the
+// given raw actions, returning the ones which failed ordered by their index.
+// An action failing doesn't stop the remaining actions from being performed.
+//
+// Actions are performed concurrently, limited by the global action-concurrency
+// and the alert's MaxConcurrency, except for actions sharing the same group,
+// which are performed sequentially in the order they're given. If
+// queue.Default is set the actions are pushed into it instead, and its workers
+// apply the same ordering and MaxConcurrency
+func (a Alert) performActions(c context.Context, actionsRaw []interface{}) []ActionError {
+	return performActions(a.Name, a.MaxConcurrency, c, actionsRaw)
+}
+
+// performActions is Alert.performActions, for the given alert name and
+// MaxConcurrency
+func performActions(name string, maxConcurrency int, c context.Context, actionsRaw []interface{}) []ActionError {
+	var failed []ActionError
+	var groups [][]indexedAction
+	groupIdx := map[string]int{}
+	for i := range actionsRaw {
+		kv := logrus.Fields{
+			"name": name,
+		}
+		if action.Templated(actionsRaw[i]) {
+			rendered, err := action.Render(actionsRaw[i], c)
+			if err != nil {
+				kv["err"] = err
+				log.LogError.WithFields(kv).Errorln("error rendering action")
+				failed = append(failed, ActionError{Index: i, Err: err})
+				continue
+			}
+			actionsRaw[i] = rendered
+		}
+
+		act, err := action.ToActioner(actionsRaw[i])
+		if err != nil {
+			kv["err"] = err
+			log.LogError.WithFields(kv).Errorln("error unpacking action")
+			failed = append(failed, ActionError{Index: i, Err: err})
+			continue
+		}
+
+		kv["action"] = act.Type
+		if queue.Default != nil {
+			log.LogAccess.WithFields(kv).Infoln("queueing action")
+			if err := queue.Default.Push(actionsRaw[i].(map[string]interface{}), c, maxConcurrency); err != nil {
+				kv["err"] = err
+				log.LogError.WithFields(kv).Errorln("failed to queue action")
+				failed = append(failed, ActionError{Index: i, Type: act.Type, Err: err})
+			}
+			continue
+		}
+
+		ia := indexedAction{index: i, Action: act}
+		if act.Group == "" {
+			groups = append(groups, []indexedAction{ia})
+		} else if gi, ok := groupIdx[act.Group]; ok {
+			groups[gi] = append(groups[gi], ia)
+		} else {
+			groupIdx[act.Group] = len(groups)
+			groups = append(groups, []indexedAction{ia})
+		}
+	}
+
+	var alertSem chan struct{}
+	if maxConcurrency > 0 {
+		alertSem = make(chan struct{}, maxConcurrency)
+	}
+	// the slots are taken for every attempt at an action, so they're free
+	// while it waits to be retried
+	acquire := func() func() {
+		if alertSem != nil {
+			alertSem <- struct{}{}
+		}
+		release := acquireGlobal()
+		return func() {
+			release()
+			if alertSem != nil {
+				<-alertSem
+			}
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, group := range groups {
+		wg.Add(1)
+		go func(group []indexedAction) {
+			defer wg.Done()
+			for _, ia := range group {
+				kv := logrus.Fields{
+					"name":   name,
+					"action": ia.Type,
+				}
+				log.LogAccess.WithFields(kv).Infoln("performing action")
+				if err := ia.RunLimited(c, acquire); err != nil {
+					kv["err"] = err
+					log.LogError.WithFields(kv).Errorln("failed to complete action")
+					mu.Lock()
+					failed = append(failed, ActionError{Index: ia.index, Type: ia.Type, Err: err})
+					mu.Unlock()
+				}
+			}
+		}(group)
+	}
+	wg.Wait()
+
+	sort.Slice(failed, func(i, j int) bool { return failed[i].Index < failed[j].Index })
+	return failed
+}
@@ -3,16 +3,22 @@ package alert
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"strconv"
 	"text/template"
 	"time"
 
 	"github.com/Akagi201/utilgo/jobber"
 	"github.com/sirupsen/logrus"
+	"github.com/tengattack/esalert/ack"
 	"github.com/tengattack/esalert/action"
 	"github.com/tengattack/esalert/context"
 	"github.com/tengattack/esalert/luautil"
+	"github.com/tengattack/esalert/route"
 	"github.com/tengattack/esalert/search"
+	"github.com/tengattack/esalert/silence"
+	"github.com/tengattack/esalert/state"
 	"github.com/tengattack/tgo/log"
 	yaml "gopkg.in/yaml.v2"
 )
@@ -27,12 +33,46 @@ type Alert struct {
 	SearchType  string            `yaml:"search_type"`
 	Search      search.Dict       `yaml:"search"`
 	SearchQuery string            `yaml:"search_query"`
+	Condition   string            `yaml:"condition"`
+	Actions     []search.Dict     `yaml:"actions"`
 	Process     luautil.LuaRunner `yaml:"process"`
+	// Severity and Labels are used to route the alert's notifications to
+	// receivers, see the route package
+	Severity string            `yaml:"severity"`
+	Labels   map[string]string `yaml:"labels"`
+	// MuteDuring lists the windows during which the alert still runs, but its
+	// actions are suppressed
+	MuteDuring []MuteWindow `yaml:"mute_during"`
+	// InhibitedBy selects other alerts which suppress the alert's actions
+	// while they're firing
+	InhibitedBy []Inhibitor `yaml:"inhibited_by"`
+	// DependsOn names other alerts, the alert isn't run at all while any of
+	// them is firing
+	DependsOn []string `yaml:"depends_on"`
+	// Escalation lists steps of actions which are performed once the alert
+	// has been firing for long enough
+	Escalation []EscalationStep `yaml:"escalation"`
+	// For is how long the alert must be active, i.e. its process step keep
+	// returning actions, before it fires. Either a duration string (e.g.
+	// "5m") or a number of consecutive runs
+	For string `yaml:"for"`
+	// FlapDetection, if set, suppresses the notifications of the alert while
+	// it keeps changing between firing and resolved
+	FlapDetection *FlapDetection `yaml:"flap_detection"`
+	// MaxConcurrency limits how many of the alert's actions are performed at
+	// the same time, 0 means only the global action-concurrency limit applies
+	MaxConcurrency int `yaml:"max_concurrency"`
 
 	Jobber         *jobber.FullTimeSpec
 	SearchIndexTPL *template.Template
 	SearchTypeTPL  *template.Template
 	SearchTPL      *template.Template
+	Cond           *Condition
+
+	// actions defined in yaml, converted into the form returned by process
+	staticActions []interface{}
+	forDuration   time.Duration
+	forRuns       int
 }
 
 func templatizeHelper(i interface{}, lastErr error) (*template.Template, error) {
@@ -74,27 +114,217 @@ func (a *Alert) Init() error {
 	}
 	a.Jobber = jb
 
+	if a.Condition != "" {
+		if a.Cond, err = ParseCondition(a.Condition); err != nil {
+			return fmt.Errorf("parsing condition: %s", err)
+		}
+	}
+
+	for i := range a.MuteDuring {
+		if err := a.MuteDuring[i].init(); err != nil {
+			return fmt.Errorf("parsing mute window %d: %s", i, err)
+		}
+	}
+
+	for i := range a.InhibitedBy {
+		if err := a.InhibitedBy[i].init(); err != nil {
+			return fmt.Errorf("parsing inhibitor %d: %s", i, err)
+		}
+	}
+	for _, name := range a.DependsOn {
+		if name == a.Name {
+			return errors.New("alert depends on itself")
+		}
+	}
+
+	if a.staticActions, err = staticActionDefs(a.Actions); err != nil {
+		return err
+	}
+
+	for i := range a.Escalation {
+		if err := a.Escalation[i].init(); err != nil {
+			return fmt.Errorf("parsing escalation step %d: %s", i, err)
+		}
+		if i > 0 && a.Escalation[i].after < a.Escalation[i-1].after {
+			return fmt.Errorf("escalation step %d comes before the previous one", i)
+		}
+	}
+
+	a.forDuration, a.forRuns = 0, 0
+	if a.For != "" {
+		if n, err := strconv.Atoi(a.For); err == nil && n > 0 {
+			a.forRuns = n
+		} else if a.forDuration, err = time.ParseDuration(a.For); err != nil || a.forDuration <= 0 {
+			return fmt.Errorf("for must be a positive duration or number of runs: %q", a.For)
+		}
+	}
+
+	if a.FlapDetection != nil {
+		if err := a.FlapDetection.init(); err != nil {
+			return fmt.Errorf("parsing flap detection: %s", err)
+		}
+	}
+
+	if err := luautil.ValidateSandbox(a.Process.Sandbox); err != nil {
+		return err
+	}
+
+	if a.Cond != nil && !a.hasProcess() && len(a.staticActions) == 0 && len(a.Escalation) == 0 {
+		return errors.New("condition set without process, actions or escalation")
+	}
+	if a.Cond == nil && !a.hasProcess() && len(a.Escalation) > 0 {
+		return errors.New("escalation set without process or condition")
+	}
+
 	return nil
 }
 
-func (a Alert) Run() {
+func (a Alert) hasProcess() bool {
+	return a.Process.File != "" || a.Process.Inline != ""
+}
+
+// staticActionDefs converts actions defined in yaml into the form returned by
+// process, and validates them
+func staticActionDefs(ds []search.Dict) ([]interface{}, error) {
+	defs := make([]interface{}, len(ds))
+	for i := range ds {
+		def := plainMap(ds[i])
+		if _, ok := def["template"]; !ok {
+			// actions defined in yaml are always rendered, unless they
+			// explicitly opt out
+			def["template"] = true
+		}
+		if _, err := action.ToActioner(def); err != nil {
+			return nil, fmt.Errorf("parsing action %d: %s", i, err)
+		}
+		defs[i] = def
+	}
+	return defs, nil
+}
+
+// untemplated drops the template field of the actions returned by the process
+// step. Their values may come from the hits, so only actions defined in yaml
+// are rendered as templates
+func untemplated(actions []interface{}) []interface{} {
+	for _, def := range actions {
+		if m, ok := def.(map[string]interface{}); ok {
+			delete(m, "template")
+		}
+	}
+	return actions
+}
+
+// plainMap converts the Dict, and any Dicts nested in it, into the plain maps
+// actions are unpacked from
+func plainMap(d search.Dict) map[string]interface{} {
+	m := make(map[string]interface{}, len(d))
+	for k, v := range d {
+		m[k] = plainValue(v)
+	}
+	return m
+}
+
+func plainValue(v interface{}) interface{} {
+	switch vv := v.(type) {
+	case search.Dict:
+		return plainMap(vv)
+	case []interface{}:
+		out := make([]interface{}, len(vv))
+		for i := range vv {
+			out[i] = plainValue(vv[i])
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// ActionError describes an action which failed to be performed
+type ActionError struct {
+	Index int    // The action's index, static actions coming before the ones returned by process
+	Type  string // The action's type, may be empty if it couldn't be unpacked
+	Err   error
+}
+
+func (e ActionError) Error() string {
+	return fmt.Sprintf("action %d (%s): %s", e.Index, e.Type, e.Err)
+}
+
+// RunResult describes the outcome of a single run of an alert
+type RunResult struct {
+	// Err is set if the alert failed before any actions could be performed
+	Err error
+	// Actions is the number of actions defined on the alert and returned by
+	// the process step
+	Actions int
+	// Pending is set if the alert's actions weren't performed because it
+	// hasn't been active for long enough, see Alert.For
+	Pending bool
+	// Acknowledged is set if the alert's actions were suppressed because it
+	// was acknowledged
+	Acknowledged bool
+	// Flapping is set if the alert's actions were suppressed because it's
+	// flapping, and the notice about it was already sent
+	Flapping bool
+	// Muted is set if the alert's actions were suppressed by one of its mute
+	// windows
+	Muted bool
+	// SkippedFor is the name of the alert the alert depends on, which was
+	// firing so the alert wasn't run
+	SkippedFor string
+	// InhibitedBy is the name of the alert which inhibited the alert's
+	// actions
+	InhibitedBy string
+	// SilencedBy is the ID of the silence which muted the alert's actions
+	SilencedBy string
+	// Grouped lists the receivers the alert's notification was buffered for,
+	// to be sent with the other notifications in its group
+	Grouped []string
+	// FailedActions lists the actions which ultimately failed, after all of
+	// their retries (or failed to be queued)
+	FailedActions []ActionError
+}
+
+// Run performs the alert's search step, and if its condition (if any) is met
+// the process step. Then every action defined on the alert, followed by every
+// action returned by the process step, is performed, see performActions
+func (a Alert) Run() RunResult {
 	kv := logrus.Fields{
 		"name": a.Name,
 	}
+	if dep, ok := a.failingDependency(); ok {
+		kv["dependency"] = dep
+		log.LogAccess.WithFields(kv).Infoln("skipping alert, dependency is firing")
+		a.skipped(time.Now())
+		return RunResult{SkippedFor: dep}
+	}
 	log.LogAccess.WithFields(kv).Infoln("running alert")
 
 	now := time.Now()
+	st := state.Get(a.Name)
 	c := context.Context{
-		Name:      a.Name,
-		StartedTS: uint64(now.Unix()),
-		Time:      now,
+		Name:         a.Name,
+		StartedTS:    uint64(now.Unix()),
+		Time:         now,
+		Severity:     a.Severity,
+		Acknowledged: st.Acknowledged,
+		Flapping:     st.Flapping,
+		Previous:     st.Previous,
+	}
+	// left empty if ack links aren't enabled
+	c.AckURL, _ = ack.URL(a.Name)
+	if len(a.Labels) > 0 {
+		c.Labels = make(map[string]string, len(a.Labels))
+		for k, v := range a.Labels {
+			c.Labels[k] = v
+		}
 	}
 
 	searchIndex, searchType, searchQuery, err := a.CreateSearch(c)
 	if err != nil {
 		kv["err"] = err
 		log.LogError.WithFields(kv).Errorln("failed to create search data")
-		return
+		return RunResult{Err: err}
 	}
 
 	if searchIndex != "" {
@@ -103,45 +333,235 @@ func (a Alert) Run() {
 		if err != nil {
 			kv["err"] = err
 			log.LogError.WithFields(kv).Errorln("failed at search step")
-			return
+			return RunResult{Err: err}
 		}
 		c.Result = res
 	}
 
-	log.LogAccess.WithFields(kv).Debugln("running process step")
-	processRes, ok := a.Process.Do(c)
-	if !ok {
-		log.LogError.WithFields(kv).Errorln("failed at process step")
-		return
+	if a.Cond != nil {
+		log.LogAccess.WithFields(kv).Debugln("evaluating condition")
+		ok, err := a.Cond.Eval(c)
+		if err != nil {
+			kv["err"] = err
+			log.LogError.WithFields(kv).Errorln("failed to evaluate condition")
+			return RunResult{Err: err}
+		}
+		if !ok {
+			log.LogAccess.WithFields(kv).Debugln("condition not met")
+			a.record(false, c, nil, now)
+			return RunResult{}
+		}
+	}
+
+	actionsRaw := make([]interface{}, 0, len(a.staticActions))
+	actionsRaw = append(actionsRaw, a.staticActions...)
+
+	// without a process step the alert's notification is routed if it has a
+	// severity or labels, with one it's routed if the process step returns a
+	// table instead of a list of actions
+	routed := c.Severity != "" || len(c.Labels) > 0
+	var processRes interface{}
+	if a.hasProcess() {
+		log.LogAccess.WithFields(kv).Debugln("running process step")
+		var err error
+		if processRes, err = a.Process.Do(c); err != nil {
+			kv["err"] = err
+			log.LogError.WithFields(kv).Errorln("failed at process step")
+			return RunResult{Err: fmt.Errorf("failed at process step: %s", err)}
+		}
+
+		// if processRes is neither, no actions were returned, which is also
+		// the case if it's nil or false
+		routed = false
+		switch pr := processRes.(type) {
+		case []interface{}:
+			actionsRaw = append(actionsRaw, untemplated(pr)...)
+		case map[string]interface{}:
+			applyNotification(&c, pr)
+			processActions, _ := pr["actions"].([]interface{})
+			actionsRaw = append(actionsRaw, untemplated(processActions)...)
+			routed = true
+		}
+	}
+
+	// receivers which group their notifications are only sent them once the
+	// alert turns out not to be suppressed
+	var grouped []string
+	if routed && route.Enabled() {
+		receivers := route.Match(notificationLabels(c))
+		log.LogAccess.WithFields(kv).WithField("receivers", receivers).Debugln("routed notification")
+		for _, name := range receivers {
+			if _, ok := route.GroupingOf(name); ok {
+				grouped = append(grouped, name)
+			} else {
+				actionsRaw = append(actionsRaw, route.Actions(name)...)
+			}
+		}
 	}
 
-	// if processRes isn't an []interface{}, actionsRaw will be the nil value of
-	// []interface{}, which has a length of 0, so either way this works
-	actionsRaw, _ := processRes.([]interface{})
-	if len(actionsRaw) == 0 {
+	// an alert with escalation steps but without a process step is active
+	// whenever its condition is met, which Init makes sure it has
+	active := len(actionsRaw) > 0 || len(grouped) > 0 || (len(a.Escalation) > 0 && !a.hasProcess())
+	st = a.record(active, c, processRes, now)
+	c.Flapping = st.Flapping
+	if !active {
 		log.LogAccess.WithFields(kv).Debugln("no actions returned")
+		return RunResult{}
+	}
+	if st.Pending {
+		kv["activeRuns"] = st.ActiveRuns
+		log.LogAccess.WithFields(kv).Infoln("alert pending")
+		return RunResult{Actions: len(actionsRaw), Pending: true}
 	}
 
-	actions := make([]action.Action, len(actionsRaw))
-	for i := range actionsRaw {
-		a, err := action.ToActioner(actionsRaw[i])
-		if err != nil {
-			kv["err"] = err
-			log.LogError.WithFields(kv).Errorln("error unpacking action")
-			return
+	if st.Acknowledged {
+		kv["actions"] = len(actionsRaw)
+		log.LogAccess.WithFields(kv).Infoln("alert acknowledged, not notifying until it resolves")
+		state.Update(a.Name, func(s *state.State) { s.Suppressed = "acknowledged" })
+		return RunResult{Actions: len(actionsRaw), Acknowledged: true}
+	}
+
+	if a.muted(now) {
+		kv["actions"] = len(actionsRaw)
+		log.LogAccess.WithFields(kv).Infoln("alert muted")
+		state.Update(a.Name, func(s *state.State) { s.Suppressed = "muted" })
+		return RunResult{Actions: len(actionsRaw), Muted: true}
+	}
+
+	if name, ok := a.inhibitedBy(); ok {
+		kv["inhibitedBy"] = name
+		kv["actions"] = len(actionsRaw)
+		log.LogAccess.WithFields(kv).Infoln("alert inhibited")
+		state.Update(a.Name, func(s *state.State) { s.Suppressed = "inhibited" })
+		return RunResult{Actions: len(actionsRaw), InhibitedBy: name}
+	}
+
+	if silence.Default != nil {
+		if sl, ok := silence.Default.Silenced(notificationLabels(c), now); ok {
+			kv["silence"] = sl.ID
+			kv["actions"] = len(actionsRaw)
+			log.LogAccess.WithFields(kv).Infoln("alert silenced")
+			state.Update(a.Name, func(s *state.State) { s.Suppressed = "silenced" })
+			return RunResult{Actions: len(actionsRaw), SilencedBy: sl.ID}
 		}
-		actions[i] = a
 	}
 
-	for i := range actions {
-		kv["action"] = actions[i].Type
-		log.LogAccess.WithFields(kv).Infoln("performing action")
-		if err := actions[i].Do(c); err != nil {
-			kv["err"] = err
-			log.LogError.WithFields(kv).Errorln("failed to complete action")
-			return
+	if st.Flapping {
+		kv["actions"] = len(actionsRaw)
+		if st.FlapNotified {
+			log.LogAccess.WithFields(kv).Infoln("alert flapping")
+			state.Update(a.Name, func(s *state.State) { s.Suppressed = "flapping" })
+			return RunResult{Actions: len(actionsRaw), Flapping: true}
 		}
+		log.LogAccess.WithFields(kv).Infoln("alert started flapping, sending notice")
+		state.Update(a.Name, func(s *state.State) { s.FlapNotified = true })
+		if len(a.FlapDetection.actions) > 0 {
+			actionsRaw = append([]interface{}(nil), a.FlapDetection.actions...)
+			grouped = nil
+		}
+	}
+	var esc dueEscalation
+	escOffset := len(actionsRaw)
+	if !st.Flapping {
+		esc = a.escalationActions(now)
+		actionsRaw = append(actionsRaw, esc.actions...)
+	}
+
+	for _, name := range grouped {
+		g, _ := route.GroupingOf(name)
+		groupNotification(name, g, c)
+	}
+
+	res := RunResult{
+		Actions:       len(actionsRaw),
+		Grouped:       grouped,
+		FailedActions: a.performActions(c, actionsRaw),
+	}
+	state.Update(a.Name, func(s *state.State) { s.LastNotified = now })
+	a.escalated(esc, escOffset, res.FailedActions, kv)
+
+	if len(res.FailedActions) > 0 {
+		kv["failed"] = res.FailedActions
+		log.LogError.WithFields(kv).Errorf("%d of %d actions failed", len(res.FailedActions), res.Actions)
+	}
+	return res
+}
+
+// applyNotification sets the severity and labels of a notification returned
+// by the process step on the context
+func applyNotification(c *context.Context, n map[string]interface{}) {
+	if sev, ok := n["severity"]; ok && sev != nil {
+		c.Severity = fmt.Sprint(sev)
+	}
+	labels, _ := n["labels"].(map[string]interface{})
+	if len(labels) == 0 {
+		return
+	}
+	merged := make(map[string]string, len(c.Labels)+len(labels))
+	for k, v := range c.Labels {
+		merged[k] = v
 	}
+	for k, v := range labels {
+		merged[k] = fmt.Sprint(v)
+	}
+	c.Labels = merged
+}
+
+// notificationLabels returns the labels routes and silences are matched
+// against, the context's labels plus the alertname and severity labels
+func notificationLabels(c context.Context) map[string]string {
+	labels := make(map[string]string, len(c.Labels)+2)
+	for k, v := range c.Labels {
+		labels[k] = v
+	}
+	labels["alertname"] = c.Name
+	if c.Severity != "" {
+		labels["severity"] = c.Severity
+	}
+	return labels
+}
+
+// record records a run of the alert in its state, which was active if its
+// actions would have been performed. The alert fires once it's been active
+// for long enough, see Alert.For, and it's updated whether it's flapping
+func (a Alert) record(active bool, c context.Context, processRes interface{}, now time.Time) state.State {
+	labels := notificationLabels(c)
+	return state.Update(a.Name, func(s *state.State) {
+		s.Previous = &context.Previous{
+			StartedTS:     c.StartedTS,
+			HitCount:      c.HitCount,
+			Aggregations:  c.Aggregations,
+			ProcessResult: processRes,
+		}
+
+		if !active {
+			s.ActiveRuns = 0
+		} else if s.ActiveRuns++; s.ActiveRuns == 1 {
+			s.ActiveSince = now
+		}
+		firing := active
+		if a.forRuns > 0 {
+			firing = active && s.ActiveRuns >= a.forRuns
+		} else if a.forDuration > 0 {
+			firing = active && now.Sub(s.ActiveSince) >= a.forDuration
+		}
+		s.Pending = active && !firing
+		s.Record(firing, labels, now)
+		a.FlapDetection.update(s, now)
+	})
+}
+
+// skipped records a run of the alert which was skipped because an alert it
+// depends on was firing. It's recorded as not active, so the alert resolves and
+// its escalation starts over once it runs again, and Previous is left as it was
+func (a Alert) skipped(now time.Time) {
+	state.Update(a.Name, func(s *state.State) {
+		s.ActiveRuns = 0
+		s.Pending = false
+		s.Record(false, s.Labels, now)
+		a.FlapDetection.update(s, now)
+		s.Suppressed = "dependency"
+	})
 }
 
 func (a Alert) CreateSearch(c context.Context) (string, string, interface{}, error) {
@@ -1,16 +1,89 @@
 package alert_test
 
 import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/tengattack/esalert/alert"
+	"github.com/tengattack/esalert/config"
 	"github.com/tengattack/esalert/context"
+	"github.com/tengattack/esalert/route"
 	"github.com/tengattack/esalert/search"
+	"github.com/tengattack/esalert/silence"
+	"github.com/tengattack/esalert/state"
 	yaml "gopkg.in/yaml.v2"
 )
 
+// recorder is an http server recording the requests it gets, which the
+// actions of the alerts under test are pointed at. Alert states are reset when
+// it's created and closed
+type recorder struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	paths    []string
+	requests []string // paths followed by bodies
+	failing  bool
+}
+
+func newRecorder() *recorder {
+	state.Reset()
+	rec := &recorder{}
+	rec.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		rec.paths = append(rec.paths, r.URL.Path)
+		rec.requests = append(rec.requests, r.URL.Path+" "+string(b))
+		if rec.failing {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	return rec
+}
+
+// got returns the paths of the requests received so far
+func (rec *recorder) got() []string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]string(nil), rec.paths...)
+}
+
+// bodies returns the requests received so far, as their path and body
+func (rec *recorder) bodies() []string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]string(nil), rec.requests...)
+}
+
+func (rec *recorder) reset() {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.paths, rec.requests = nil, nil
+}
+
+// fail makes the server respond with a 500 while set
+func (rec *recorder) fail(failing bool) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.failing = failing
+}
+
+func (rec *recorder) Close() {
+	rec.Server.Close()
+	state.Reset()
+}
+
 func TestSearchTPL(t *testing.T) {
 	y := []byte(`
 interval: "* * * * *"
@@ -47,3 +120,709 @@ search: {
 	}
 	assert.Equal(t, expectedSearch, searchQuery)
 }
+
+func TestRun(t *testing.T) {
+	var flakyCalls, goodCalls int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/flaky", func(w http.ResponseWriter, r *http.Request) {
+		if flakyCalls++; flakyCalls < 3 {
+			w.WriteHeader(503)
+		}
+	})
+	mux.HandleFunc("/bad", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(400)
+	})
+	mux.HandleFunc("/good", func(w http.ResponseWriter, r *http.Request) {
+		goodCalls++
+	})
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	y := []byte(`
+name: wat
+interval: "* * * * *"
+process:
+  lua_inline: |
+    return {
+      {type = "http", method = "GET", url = "` + s.URL + `/flaky", retry = {max_attempts = 3, backoff = "1ms"}},
+      {type = "http", method = "GET", url = "` + s.URL + `/bad", retry = {max_attempts = 3, backoff = "1ms"}},
+      {type = "unknown"},
+      {type = "http", method = "GET", url = "` + s.URL + `/good"},
+    }`)
+
+	var a alert.Alert
+	require.Nil(t, yaml.Unmarshal(y, &a))
+	require.Nil(t, a.Init())
+
+	res := a.Run()
+	require.Nil(t, res.Err)
+	assert.Equal(t, 4, res.Actions)
+	assert.Equal(t, 3, flakyCalls)
+	assert.Equal(t, 1, goodCalls)
+	require.Len(t, res.FailedActions, 2)
+	assert.Equal(t, 1, res.FailedActions[0].Index)
+	assert.Equal(t, "http", res.FailedActions[0].Type)
+	assert.Equal(t, 2, res.FailedActions[1].Index)
+}
+
+func TestRunConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	var inFlight, maxInFlight int
+	var ordered []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		ordered = append(ordered, r.URL.Query().Get("n"))
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	}))
+	defer s.Close()
+
+	actions := make([]string, 6)
+	for i := range actions {
+		actions[i] = `{type = "http", method = "GET", url = "` + s.URL + `/?n=` + string(rune('a'+i)) + `"}`
+	}
+
+	a := alert.Alert{
+		Name:           "wat",
+		Interval:       "* * * * *",
+		MaxConcurrency: 2,
+	}
+	a.Process.Inline = "return {" + strings.Join(actions, ",") + "}"
+	require.Nil(t, a.Init())
+	res := a.Run()
+	require.Nil(t, res.Err)
+	assert.Empty(t, res.FailedActions)
+	assert.Equal(t, 2, maxInFlight)
+	assert.Len(t, ordered, 6)
+
+	// actions in the same group are performed one after the other, in order
+	for i := range actions {
+		actions[i] = strings.Replace(actions[i], "}", `, group = "foo"}`, 1)
+	}
+	a.MaxConcurrency = 0
+	a.Process.Inline = "return {" + strings.Join(actions, ",") + "}"
+	maxInFlight, ordered = 0, nil
+	res = a.Run()
+	require.Nil(t, res.Err)
+	assert.Equal(t, 1, maxInFlight)
+	assert.Equal(t, []string{"a", "b", "c", "d", "e", "f"}, ordered)
+}
+
+func TestCondition(t *testing.T) {
+	c := context.Context{
+		Name: "wat",
+		Result: search.Result{
+			HitInfo: search.HitInfo{
+				HitCount: 11,
+				Hits: []search.Hit{
+					{ID: "a", Source: map[string]interface{}{"level": "error"}},
+				},
+			},
+			Aggregations: map[string]interface{}{
+				"avg_latency": map[string]interface{}{"value": 500.0},
+				"nan":         map[string]interface{}{"value": 1.0},
+			},
+		},
+	}
+
+	for cond, expected := range map[string]bool{
+		"hit_count > 10":                        true,
+		"hit_count>10":                          true,
+		"hit_count <= 10":                       false,
+		"aggregations.avg_latency.value >= 500": true,
+		"aggregations.avg_latency.value > 500 or hit_count == 11":  true,
+		"aggregations.avg_latency.value > 500 && hit_count == 11":  false,
+		"hit_count < 5 or hit_count > 5 and name != 'wat'":         false,
+		`hits.0.source.level == "error" and hits.0.id == 'a'`:      true,
+		"hit_count < 5 || aggregations.avg_latency.value == 500.0": true,
+		"hit_count > 1e1 and hit_count < 12.":                      true,
+		"aggregations.nan.value == 1":                              true,
+	} {
+		cd, err := alert.ParseCondition(cond)
+		require.Nil(t, err, cond)
+		ok, err := cd.Eval(c)
+		require.Nil(t, err, cond)
+		assert.Equal(t, expected, ok, cond)
+	}
+
+	for _, cond := range []string{"", "hit_count >", "hit_count ~ 5", "hit_count > 5 and", "name == 'wat"} {
+		_, err := alert.ParseCondition(cond)
+		assert.NotNil(t, err, cond)
+	}
+
+	// only decimal numbers are numbers, e.g. inf is a path
+	for _, cond := range []string{"aggregations.nope.value > 1", "hits.1.id == 'a'", "name > 1", "hit_count < inf", "hit_count == 0x1p4"} {
+		cd, err := alert.ParseCondition(cond)
+		require.Nil(t, err, cond)
+		_, err = cd.Eval(c)
+		assert.NotNil(t, err, cond)
+	}
+}
+
+func TestStaticActions(t *testing.T) {
+	s := newRecorder()
+	defer s.Close()
+
+	y := []byte(`
+name: wat
+interval: "* * * * *"
+condition: hit_count == 0
+actions:
+  - type: http
+    method: GET
+    url: "` + s.URL + `/{{.Name}}/{{.HitCount}}"
+    group: static
+process:
+  lua_inline: |
+    return {{type = "http", method = "POST", url = "` + s.URL + `/process", body = "{{.Name}}", template = true, group = "static"}}`)
+
+	var a alert.Alert
+	require.Nil(t, yaml.Unmarshal(y, &a))
+	require.Nil(t, a.Init())
+	res := a.Run()
+	require.Nil(t, res.Err)
+	assert.Empty(t, res.FailedActions)
+	assert.Equal(t, []string{"/wat/0", "/process"}, s.got())
+	// actions returned by lua aren't rendered, even if they ask to be
+	assert.Equal(t, []string{"/wat/0 ", "/process {{.Name}}"}, s.bodies())
+
+	// the rendered action doesn't leak into the next run
+	s.reset()
+	a.Run()
+	assert.Equal(t, []string{"/wat/0", "/process"}, s.got())
+
+	s.reset()
+	a.Condition = "hit_count > 0"
+	require.Nil(t, a.Init())
+	a.Run()
+	assert.Empty(t, s.got())
+
+	a.Condition = "hit_count >"
+	assert.NotNil(t, a.Init())
+	a.Condition = ""
+	a.Actions[0]["type"] = "nope"
+	assert.NotNil(t, a.Init())
+}
+
+func TestRouting(t *testing.T) {
+	s := newRecorder()
+	defer s.Close()
+
+	require.Nil(t, route.Load([]config.Receiver{
+		{Name: "default", Actions: []map[string]interface{}{
+			{"type": "http", "method": "GET", "url": s.URL + "/default/{{.Name}}"},
+		}},
+		{Name: "payments", Actions: []map[string]interface{}{
+			{"type": "http", "method": "GET", "url": s.URL + "/payments/{{.Severity}}/{{.Labels.team}}"},
+		}},
+	}, config.Route{
+		Receiver: "default",
+		Routes: []config.Route{
+			{Receiver: "payments", Match: map[string]string{"team": "payments"}},
+		},
+	}))
+	defer route.Load(nil, config.Route{})
+
+	a := alert.Alert{
+		Name:     "wat",
+		Interval: "* * * * *",
+	}
+	a.Process.Inline = `return {severity = "critical", labels = {team = "payments"}}`
+	require.Nil(t, a.Init())
+	res := a.Run()
+	require.Nil(t, res.Err)
+	assert.Empty(t, res.FailedActions)
+	assert.Equal(t, []string{"/payments/critical/payments"}, s.got())
+
+	// a list of actions isn't routed
+	s.reset()
+	a.Process.Inline = `return {}`
+	a.Run()
+	assert.Empty(t, s.got())
+
+	// without a process step the alert's own labels are used
+	s.reset()
+	a.Process.Inline = ""
+	a.Severity = "warning"
+	require.Nil(t, a.Init())
+	a.Run()
+	assert.Equal(t, []string{"/default/wat"}, s.got())
+}
+
+func TestSilence(t *testing.T) {
+	s := newRecorder()
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "esalert-silence")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	silence.Default, err = silence.Open(filepath.Join(dir, "silences.json"))
+	require.Nil(t, err)
+	defer func() { silence.Default = nil }()
+
+	sl, err := silence.Default.Add(silence.Silence{
+		Matchers:  []silence.Matcher{{Name: "alertname", Value: "wat"}},
+		EndsAt:    time.Now().Add(time.Hour),
+		CreatedBy: "someone",
+	})
+	require.Nil(t, err)
+
+	a := alert.Alert{
+		Name:     "wat",
+		Interval: "* * * * *",
+	}
+	a.Process.Inline = `return {{type = "http", method = "GET", url = "` + s.URL + `"}}`
+	require.Nil(t, a.Init())
+	res := a.Run()
+	require.Nil(t, res.Err)
+	assert.Equal(t, sl.ID, res.SilencedBy)
+	assert.Empty(t, s.got())
+
+	_, err = silence.Default.Expire(sl.ID)
+	require.Nil(t, err)
+	res = a.Run()
+	assert.Empty(t, res.SilencedBy)
+	assert.Len(t, s.got(), 1)
+}
+
+func TestMuteDuring(t *testing.T) {
+	y := []byte(`
+name: wat
+interval: "* * * * *"
+mute_during:
+  - cron: "*/15 0-5 * * sat,7"
+    timezone: Asia/Shanghai
+  - weekdays: [fri, Saturday]
+    start: "22:00"
+    end: "02:30"
+    timezone: UTC
+  - start: "12:00"
+    end: "13:00"
+    timezone: UTC
+  - cron: "0 12 1 * mon"
+    timezone: UTC`)
+
+	var a alert.Alert
+	require.Nil(t, yaml.Unmarshal(y, &a))
+	require.Nil(t, a.Init())
+
+	utc := func(s string) time.Time {
+		tm, err := time.Parse(time.RFC3339, s)
+		require.Nil(t, err)
+		return tm
+	}
+	cron, days, noon, dayOr := a.MuteDuring[0], a.MuteDuring[1], a.MuteDuring[2], a.MuteDuring[3]
+
+	// 2020-01-04 is a saturday
+	assert.True(t, cron.Contains(utc("2020-01-03T16:30:00Z")))  // sat 00:30 in Shanghai
+	assert.False(t, cron.Contains(utc("2020-01-03T16:31:00Z"))) // not a multiple of 15
+	assert.True(t, cron.Contains(utc("2020-01-04T21:45:00Z")))  // sun 05:45 in Shanghai
+	assert.False(t, cron.Contains(utc("2020-01-04T22:00:00Z"))) // sun 06:00 in Shanghai
+	assert.False(t, cron.Contains(utc("2020-01-05T16:00:00Z"))) // mon 00:00 in Shanghai
+
+	assert.True(t, days.Contains(utc("2020-01-03T22:00:00Z")))  // fri 22:00
+	assert.True(t, days.Contains(utc("2020-01-04T02:29:00Z")))  // sat 02:29, still fri's window
+	assert.False(t, days.Contains(utc("2020-01-04T02:30:00Z"))) // sat 02:30
+	assert.True(t, days.Contains(utc("2020-01-05T01:00:00Z")))  // sun 01:00, sat's window
+	assert.False(t, days.Contains(utc("2020-01-05T22:00:00Z"))) // sun 22:00
+	assert.False(t, days.Contains(utc("2020-01-02T23:00:00Z"))) // thu 23:00
+
+	assert.True(t, noon.Contains(utc("2020-01-01T12:59:00Z")))
+	assert.False(t, noon.Contains(utc("2020-01-01T13:00:00Z")))
+
+	// restricting both day of month and day of week matches either
+	assert.True(t, dayOr.Contains(utc("2020-01-01T12:00:00Z")))  // wed the 1st
+	assert.True(t, dayOr.Contains(utc("2020-01-06T12:00:00Z")))  // mon the 6th
+	assert.False(t, dayOr.Contains(utc("2020-01-07T12:00:00Z"))) // tue the 7th
+
+	for _, w := range []alert.MuteWindow{
+		{},
+		{Start: "12:00"},
+		{Start: "25:00", End: "01:00"},
+		{Start: "12:00", End: "13:00", Weekdays: []string{"caturday"}},
+		{Start: "12:00", End: "13:00", Timezone: "Nowhere/Special"},
+		{Cron: "* * * *"},
+		{Cron: "60 * * * *"},
+		{Cron: "*/0 * * * *"},
+		{Cron: "* * * * *", Start: "12:00"},
+	} {
+		a.MuteDuring = []alert.MuteWindow{w}
+		assert.NotNil(t, a.Init(), "%+v", w)
+	}
+}
+
+func TestMutedRun(t *testing.T) {
+	s := newRecorder()
+	defer s.Close()
+
+	a := alert.Alert{
+		Name:       "wat",
+		Interval:   "* * * * *",
+		MuteDuring: []alert.MuteWindow{{Cron: "* * * * *"}},
+	}
+	a.Process.Inline = `return {{type = "http", method = "GET", url = "` + s.URL + `"}}`
+	require.Nil(t, a.Init())
+	res := a.Run()
+	require.Nil(t, res.Err)
+	assert.True(t, res.Muted)
+	assert.Empty(t, s.got())
+
+	// the alert's state is still recorded
+	st := state.Get("wat")
+	assert.True(t, st.Firing)
+	assert.Equal(t, "muted", st.Suppressed)
+	assert.True(t, st.LastNotified.IsZero())
+
+	a.MuteDuring = nil
+	res = a.Run()
+	assert.False(t, res.Muted)
+	assert.Len(t, s.got(), 1)
+	st = state.Get("wat")
+	assert.Empty(t, st.Suppressed)
+	assert.False(t, st.LastNotified.IsZero())
+}
+
+func TestInhibition(t *testing.T) {
+	s := newRecorder()
+	defer s.Close()
+
+	y := []byte(`
+- name: cluster_down
+  interval: "* * * * *"
+  labels:
+    scope: cluster
+  process:
+    lua_inline: return {}
+- name: svc
+  interval: "* * * * *"
+  inhibited_by:
+    - cluster_down
+  process:
+    lua_inline: return {{type = "http", method = "GET", url = "` + s.URL + `"}}
+- name: svc_by_label
+  interval: "* * * * *"
+  inhibited_by:
+    - match_re:
+        scope: clus.*
+  process:
+    lua_inline: return {{type = "http", method = "GET", url = "` + s.URL + `"}}
+- name: svc_dependent
+  interval: "* * * * *"
+  depends_on: [cluster_down]
+  process:
+    lua_inline: return {{type = "http", method = "GET", url = "` + s.URL + `"}}`)
+
+	var alerts []alert.Alert
+	require.Nil(t, yaml.Unmarshal(y, &alerts))
+	for i := range alerts {
+		require.Nil(t, alerts[i].Init())
+	}
+	down, svc, byLabel, dependent := alerts[0], alerts[1], alerts[2], alerts[3]
+	assert.Equal(t, "cluster_down", svc.InhibitedBy[0].Alert)
+
+	// the cluster isn't down, so nothing is suppressed
+	down.Run()
+	assert.Empty(t, svc.Run().InhibitedBy)
+	assert.Empty(t, byLabel.Run().InhibitedBy)
+	assert.Empty(t, dependent.Run().SkippedFor)
+	assert.Len(t, s.got(), 3)
+
+	s.reset()
+	down.Process.Inline = `return {{type = "log", message = "down"}}`
+	down.Run()
+	assert.Equal(t, "cluster_down", svc.Run().InhibitedBy)
+	assert.Equal(t, "cluster_down", byLabel.Run().InhibitedBy)
+	assert.Equal(t, "cluster_down", dependent.Run().SkippedFor)
+	assert.Empty(t, s.got())
+	assert.Equal(t, "inhibited", state.Get("svc").Suppressed)
+	assert.True(t, state.Get("svc").Firing)
+	// a skipped alert resolves
+	assert.Equal(t, "dependency", state.Get("svc_dependent").Suppressed)
+	assert.False(t, state.Get("svc_dependent").Firing)
+
+	svc.InhibitedBy = []alert.Inhibitor{{}}
+	assert.NotNil(t, svc.Init())
+	svc.InhibitedBy = []alert.Inhibitor{{MatchRE: map[string]string{"scope": "("}}}
+	assert.NotNil(t, svc.Init())
+	svc.InhibitedBy = nil
+	svc.DependsOn = []string{"svc"}
+	assert.NotNil(t, svc.Init())
+}
+
+func TestGrouping(t *testing.T) {
+	s := newRecorder()
+	defer s.Close()
+	config.Opts.SlackWebhook = s.URL + "/slack"
+	defer func() { config.Opts.SlackWebhook = "" }()
+
+	require.Nil(t, route.Load([]config.Receiver{
+		{
+			Name:      "grouped",
+			GroupBy:   []string{"team"},
+			GroupWait: "100ms",
+			Actions: []map[string]interface{}{
+				{"type": "slack", "text": "{{.Labels.team}}: {{.Name}} fired"},
+				{"type": "http", "method": "POST", "url": s.URL + "/{{.Labels.team}}"},
+				// other fields than the message can't be merged, so one is
+				// sent for each of their values
+				{"type": "http", "method": "POST", "url": s.URL + "/{{.Labels.team}}/{{.Name}}"},
+			},
+		},
+	}, config.Route{Receiver: "grouped"}))
+	defer route.Load(nil, config.Route{})
+
+	for _, n := range []struct{ name, team string }{
+		{"a", "payments"}, {"b", "payments"}, {"c", "search"}, {"a", "payments"},
+	} {
+		a := alert.Alert{
+			Name:     n.name,
+			Interval: "* * * * *",
+			Labels:   map[string]string{"team": n.team},
+		}
+		require.Nil(t, a.Init())
+		res := a.Run()
+		require.Nil(t, res.Err)
+		assert.Equal(t, []string{"grouped"}, res.Grouped)
+	}
+
+	assert.Empty(t, s.got())
+
+	require.Eventually(t, func() bool { return len(s.got()) == 7 }, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	bodies := s.bodies()
+	sort.Strings(bodies)
+	assert.Equal(t, []string{
+		"/payments ",
+		"/payments/a ",
+		"/payments/b ",
+		"/search ",
+		"/search/c ",
+		`/slack {"text":"payments: a fired\npayments: b fired"}`,
+		`/slack {"text":"search: c fired"}`,
+	}, bodies)
+}
+
+func TestEscalation(t *testing.T) {
+	s := newRecorder()
+	defer s.Close()
+
+	y := []byte(`
+name: wat
+interval: "* * * * *"
+condition: hit_count == 0
+escalation:
+  - actions:
+      - {type: http, method: GET, url: "` + s.URL + `/primary"}
+  - after: 50ms
+    actions:
+      - {type: http, method: GET, url: "` + s.URL + `/secondary"}
+  - after: 1h
+    actions:
+      - {type: http, method: GET, url: "` + s.URL + `/manager"}`)
+
+	var a alert.Alert
+	require.Nil(t, yaml.Unmarshal(y, &a))
+	require.Nil(t, a.Init())
+
+	a.Run()
+	a.Run()
+	assert.Equal(t, []string{"/primary"}, s.got())
+	time.Sleep(60 * time.Millisecond)
+
+	// a step whose delivery failed is retried on the next run
+	s.fail(true)
+	a.Run()
+	assert.Equal(t, []string{"/primary", "/secondary"}, s.got())
+	assert.Equal(t, 1, state.Get("wat").Escalated)
+	s.fail(false)
+	a.Run()
+	assert.Equal(t, []string{"/primary", "/secondary", "/secondary"}, s.got())
+	assert.Equal(t, 2, state.Get("wat").Escalated)
+
+	// resolving starts over
+	s.reset()
+	a.Condition = "hit_count > 0"
+	require.Nil(t, a.Init())
+	a.Run()
+	a.Condition = "hit_count == 0"
+	require.Nil(t, a.Init())
+	a.Run()
+	assert.Equal(t, []string{"/primary"}, s.got())
+
+	// acknowledging stops further steps
+	assert.True(t, state.Acknowledge("wat"))
+	time.Sleep(60 * time.Millisecond)
+	a.Run()
+	assert.Equal(t, []string{"/primary"}, s.got())
+
+	a.Escalation[0].Receiver = "nope"
+	assert.NotNil(t, a.Init())
+	a.Escalation[0].Receiver = ""
+	a.Escalation[0].After = "1h"
+	assert.NotNil(t, a.Init())
+
+	// without a process step the condition decides whether the alert is firing
+	a = alert.Alert{}
+	require.Nil(t, yaml.Unmarshal(y, &a))
+	a.Condition = ""
+	assert.NotNil(t, a.Init())
+}
+
+func TestAcknowledged(t *testing.T) {
+	s := newRecorder()
+	defer s.Close()
+
+	a := alert.Alert{
+		Name:     "wat",
+		Interval: "* * * * *",
+	}
+	a.Process.Inline = `return {{type = "http", method = "GET", url = "` + s.URL + `/" .. tostring(ctx.Acknowledged)}}`
+	require.Nil(t, a.Init())
+	a.Run()
+	assert.Equal(t, []string{"/false"}, s.got())
+
+	require.True(t, state.Acknowledge("wat"))
+	res := a.Run()
+	assert.True(t, res.Acknowledged)
+	assert.Equal(t, []string{"/false"}, s.got())
+
+	// once resolved the alert notifies again
+	a.Process.Inline = `return {}`
+	a.Run()
+	a.Process.Inline = `return {{type = "http", method = "GET", url = "` + s.URL + `/" .. tostring(ctx.Acknowledged)}}`
+	a.Run()
+	assert.Equal(t, []string{"/false", "/false"}, s.got())
+}
+
+func TestFlapDetection(t *testing.T) {
+	s := newRecorder()
+	defer s.Close()
+
+	y := []byte(`
+name: wat
+interval: "* * * * *"
+flap_detection:
+  window: 1h
+  threshold: 3
+  actions:
+    - {type: http, method: GET, url: "` + s.URL + `/flapping/{{.Flapping}}"}`)
+
+	var a alert.Alert
+	require.Nil(t, yaml.Unmarshal(y, &a))
+	require.Nil(t, a.Init())
+
+	fire := `return {{type = "http", method = "GET", url = "` + s.URL + `/fire/" .. tostring(ctx.Flapping)}}`
+	for i := 0; i < 2; i++ {
+		a.Process.Inline = fire
+		a.Run()
+		a.Process.Inline = `return {}`
+		a.Run()
+	}
+	assert.Equal(t, []string{"/fire/false", "/fire/false"}, s.got())
+	assert.False(t, state.Get("wat").Flapping)
+
+	// the 4th transition exceeds the threshold, so a notice is sent instead
+	s.reset()
+	a.Process.Inline = fire
+	res := a.Run()
+	assert.False(t, res.Flapping)
+	assert.True(t, state.Get("wat").Flapping)
+	assert.Equal(t, []string{"/flapping/true"}, s.got())
+	res = a.Run()
+	assert.True(t, res.Flapping)
+	assert.Equal(t, []string{"/flapping/true"}, s.got())
+
+	// lua sees the flapping state
+	a.FlapDetection.Actions = nil
+	require.Nil(t, a.Init())
+	state.Update("wat", func(s *state.State) { s.FlapNotified = false })
+	s.reset()
+	a.Run()
+	assert.Equal(t, []string{"/fire/true"}, s.got())
+
+	a.FlapDetection.Window = "nope"
+	assert.NotNil(t, a.Init())
+	a.FlapDetection.Window = "1h"
+	a.FlapDetection.Threshold = 0
+	assert.NotNil(t, a.Init())
+}
+
+func TestFor(t *testing.T) {
+	s := newRecorder()
+	defer s.Close()
+
+	a := alert.Alert{
+		Name:     "wat",
+		Interval: "* * * * *",
+		For:      "3",
+	}
+	fire := `return {{type = "http", method = "GET", url = "` + s.URL + `"}}`
+	a.Process.Inline = fire
+	require.Nil(t, a.Init())
+
+	assert.True(t, a.Run().Pending)
+	assert.True(t, a.Run().Pending)
+	st := state.Get("wat")
+	assert.True(t, st.Pending)
+	assert.False(t, st.Firing)
+	assert.Equal(t, 2, st.ActiveRuns)
+	assert.Empty(t, s.got())
+	assert.False(t, a.Run().Pending)
+	assert.Len(t, s.got(), 1)
+	assert.True(t, state.Get("wat").Firing)
+
+	// a single inactive run starts over
+	a.Process.Inline = `return {}`
+	a.Run()
+	a.Process.Inline = fire
+	assert.True(t, a.Run().Pending)
+	assert.False(t, state.Get("wat").Firing)
+
+	a.For = "50ms"
+	require.Nil(t, a.Init())
+	assert.True(t, a.Run().Pending)
+	time.Sleep(60 * time.Millisecond)
+	assert.False(t, a.Run().Pending)
+	assert.Len(t, s.got(), 2)
+
+	for _, f := range []string{"-1", "0", "nope", "-5m"} {
+		a.For = f
+		assert.NotNil(t, a.Init(), f)
+	}
+}
+
+func TestPrevious(t *testing.T) {
+	state.Reset()
+	defer state.Reset()
+
+	a := alert.Alert{
+		Name:     "wat",
+		Interval: "* * * * *",
+	}
+	a.Process.Inline = `
+		local n = 1
+		if ctx.Previous ~= nil and ctx.Previous.ProcessResult ~= nil then
+			n = ctx.Previous.ProcessResult.n + 1
+		end
+		return {n = n, prev_started = ctx.Previous and ctx.Previous.StartedTS or 0}`
+	require.Nil(t, a.Init())
+
+	a.Run()
+	prev := state.Get("wat").Previous
+	require.NotNil(t, prev)
+	assert.Equal(t, map[string]interface{}{"n": 1, "prev_started": 0}, prev.ProcessResult)
+	started := prev.StartedTS
+
+	a.Run()
+	prev = state.Get("wat").Previous
+	assert.Equal(t, map[string]interface{}{"n": 2, "prev_started": int(started)}, prev.ProcessResult)
+}
@@ -0,0 +1,298 @@
+package alert
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/tengattack/esalert/context"
+)
+
+// Condition is a parsed condition expression, which is evaluated against the
+// alert context in go. A condition is made up of comparisons joined by "and"
+// and "or" (or "&&" and "||"), "and" binding tighter than "or". A comparison
+// compares two operands with one of ">", ">=", "<", "<=", "==" or "!=". Each
+// operand is either a decimal number, a quoted string, or a dotted path into
+// the context, for example:
+//
+//	hit_count > 10
+//	aggregations.avg_latency.value >= 500 and hit_count > 0
+//	hits.0.source.level == "error"
+type Condition struct {
+	raw string
+	or  [][]comparison // comparisons and-ed together, or-ed together
+}
+
+type operand struct {
+	path  []string
+	value interface{} // float64 or string, set if path is nil
+}
+
+type comparison struct {
+	left, right operand
+	op          string
+}
+
+var condOps = []string{">=", "<=", "==", "!=", ">", "<"}
+
+// ParseCondition parses the given condition expression
+func ParseCondition(s string) (*Condition, error) {
+	tokens, err := condTokens(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty condition")
+	}
+
+	cond := &Condition{raw: s}
+	var and []comparison
+	for len(tokens) > 0 {
+		if len(tokens) < 3 {
+			return nil, fmt.Errorf("incomplete comparison in condition: %q", strings.Join(tokens, " "))
+		}
+		left, err := parseOperand(tokens[0])
+		if err != nil {
+			return nil, err
+		}
+		op := tokens[1]
+		if !isCondOp(op) {
+			return nil, fmt.Errorf("unknown operator in condition: %q", op)
+		}
+		right, err := parseOperand(tokens[2])
+		if err != nil {
+			return nil, err
+		}
+		and = append(and, comparison{left: left, right: right, op: op})
+		tokens = tokens[3:]
+
+		if len(tokens) == 0 {
+			break
+		}
+		switch strings.ToLower(tokens[0]) {
+		case "and", "&&":
+		case "or", "||":
+			cond.or = append(cond.or, and)
+			and = nil
+		default:
+			return nil, fmt.Errorf("expected and/or in condition, got %q", tokens[0])
+		}
+		tokens = tokens[1:]
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("condition ends with and/or")
+		}
+	}
+	cond.or = append(cond.or, and)
+	return cond, nil
+}
+
+func (c *Condition) String() string {
+	return c.raw
+}
+
+func isCondOp(s string) bool {
+	for _, op := range condOps {
+		if s == op {
+			return true
+		}
+	}
+	return false
+}
+
+// condTokens splits the expression into operands, operators and and/or
+func condTokens(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		ch := s[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			i++
+		case ch == '"' || ch == '\'':
+			j := i + 1
+			for ; j < len(s) && s[j] != ch; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string in condition")
+			}
+			tokens = append(tokens, s[i:j+1])
+			i = j + 1
+		case strings.ContainsRune("<>=!&|", rune(ch)):
+			j := i + 1
+			for j < len(s) && strings.ContainsRune("<>=!&|", rune(s[j])) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		default:
+			j := i
+			for j < len(s) && !unicode.IsSpace(rune(s[j])) && !strings.ContainsRune(`<>=!&|"'`, rune(s[j])) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// numberRe matches decimal number literals. Anything else strconv.ParseFloat
+// accepts, like "inf", "nan" or hex floats, is taken to be a path instead
+var numberRe = regexp.MustCompile(`^[+-]?([0-9]+(\.[0-9]*)?|\.[0-9]+)([eE][+-]?[0-9]+)?$`)
+
+func parseOperand(tok string) (operand, error) {
+	if q := tok[0]; q == '"' || q == '\'' {
+		return operand{value: strings.Replace(tok[1:len(tok)-1], `\`+string(q), string(q), -1)}, nil
+	}
+	if numberRe.MatchString(tok) {
+		f, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return operand{}, fmt.Errorf("invalid number in condition %q: %s", tok, err)
+		}
+		return operand{value: f}, nil
+	}
+	if isCondOp(tok) || tok == "&&" || tok == "||" {
+		return operand{}, fmt.Errorf("expected operand in condition, got %q", tok)
+	}
+	return operand{path: strings.Split(tok, ".")}, nil
+}
+
+// condRoot returns the values paths in a condition are resolved against
+func condRoot(c context.Context) map[string]interface{} {
+	hits := make([]interface{}, len(c.Hits))
+	for i, h := range c.Hits {
+		hits[i] = map[string]interface{}{
+			"index":  h.Index,
+			"type":   h.Type,
+			"id":     h.ID,
+			"score":  h.Score,
+			"source": h.Source,
+		}
+	}
+	return map[string]interface{}{
+		"name":          c.Name,
+		"took_ms":       c.TookMS,
+		"timed_out":     c.TimedOut,
+		"hit_count":     c.HitCount,
+		"hit_max_score": c.HitMaxScore,
+		"hits":          hits,
+		"aggregations":  c.Aggregations,
+	}
+}
+
+func (o operand) resolve(root map[string]interface{}) (interface{}, error) {
+	if o.path == nil {
+		return o.value, nil
+	}
+	var cur interface{} = root
+	for i, p := range o.path {
+		switch cv := cur.(type) {
+		case map[string]interface{}:
+			v, ok := cv[p]
+			if !ok {
+				return nil, fmt.Errorf("%s not found", strings.Join(o.path[:i+1], "."))
+			}
+			cur = v
+		case []interface{}:
+			idx, err := strconv.Atoi(p)
+			if err != nil || idx < 0 || idx >= len(cv) {
+				return nil, fmt.Errorf("%s not found", strings.Join(o.path[:i+1], "."))
+			}
+			cur = cv[idx]
+		default:
+			return nil, fmt.Errorf("%s not found", strings.Join(o.path[:i+1], "."))
+		}
+	}
+
+	switch v := cur.(type) {
+	case float64, string:
+		return v, nil
+	case bool:
+		if v {
+			return float64(1), nil
+		}
+		return float64(0), nil
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case nil:
+		return nil, fmt.Errorf("%s is null", strings.Join(o.path, "."))
+	default:
+		return nil, fmt.Errorf("%s is not a number or string", strings.Join(o.path, "."))
+	}
+}
+
+func (cmp comparison) eval(root map[string]interface{}) (bool, error) {
+	l, err := cmp.left.resolve(root)
+	if err != nil {
+		return false, err
+	}
+	r, err := cmp.right.resolve(root)
+	if err != nil {
+		return false, err
+	}
+
+	var c int
+	switch lv := l.(type) {
+	case float64:
+		rv, ok := r.(float64)
+		if !ok {
+			return false, fmt.Errorf("can't compare number with %q", r)
+		}
+		if lv < rv {
+			c = -1
+		} else if lv > rv {
+			c = 1
+		}
+	case string:
+		rv, ok := r.(string)
+		if !ok {
+			return false, fmt.Errorf("can't compare string %q with number", lv)
+		}
+		c = strings.Compare(lv, rv)
+	}
+
+	switch cmp.op {
+	case ">":
+		return c > 0, nil
+	case ">=":
+		return c >= 0, nil
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case "==":
+		return c == 0, nil
+	default: // "!="
+		return c != 0, nil
+	}
+}
+
+// Eval evaluates the condition against the given context
+func (c *Condition) Eval(ctx context.Context) (bool, error) {
+	root := condRoot(ctx)
+	for _, and := range c.or {
+		ok := true
+		for _, cmp := range and {
+			res, err := cmp.eval(root)
+			if err != nil {
+				return false, err
+			}
+			if !res {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,110 @@
+package alert
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tengattack/esalert/route"
+	"github.com/tengattack/esalert/search"
+	"github.com/tengattack/esalert/state"
+	"github.com/tengattack/tgo/log"
+)
+
+// EscalationStep is a step of an alert's escalation policy. Its actions,
+// and/or those of its receiver, are performed once when the alert has been
+// firing for After, unless the alert was acknowledged. Steps start over when
+// the alert resolves
+type EscalationStep struct {
+	// After is a duration string (e.g. "15m"), defaults to 0, i.e. as soon
+	// as the alert fires
+	After    string        `yaml:"after"`
+	Actions  []search.Dict `yaml:"actions"`
+	Receiver string        `yaml:"receiver"`
+
+	after   time.Duration
+	actions []interface{}
+}
+
+func (s *EscalationStep) init() error {
+	if s.After != "" {
+		var err error
+		if s.after, err = time.ParseDuration(s.After); err != nil {
+			return fmt.Errorf("parsing after: %s", err)
+		}
+	}
+	if len(s.Actions) == 0 && s.Receiver == "" {
+		return errors.New("step has no actions or receiver")
+	}
+	if s.Receiver != "" && !route.HasReceiver(s.Receiver) {
+		return fmt.Errorf("unknown receiver %q", s.Receiver)
+	}
+	var err error
+	s.actions, err = staticActionDefs(s.Actions)
+	return err
+}
+
+// dueEscalation describes the escalation steps which are due in a run of an
+// alert
+type dueEscalation struct {
+	from    int   // the index of the first due step
+	ends    []int // the end index of each due step's actions in actions
+	actions []interface{}
+}
+
+// escalationActions returns the actions of the escalation steps which are due
+// at the given time. They're only recorded as performed in the alert's state
+// by escalated, once it's known whether their actions succeeded
+func (a Alert) escalationActions(now time.Time) dueEscalation {
+	st := state.Get(a.Name)
+	esc := dueEscalation{from: st.Escalated}
+	if len(a.Escalation) == 0 || st.Acknowledged || !st.Firing {
+		return esc
+	}
+	for i := st.Escalated; i < len(a.Escalation) && now.Sub(st.Since) >= a.Escalation[i].after; i++ {
+		step := a.Escalation[i]
+		esc.actions = append(esc.actions, step.actions...)
+		if step.Receiver != "" {
+			esc.actions = append(esc.actions, route.Actions(step.Receiver)...)
+		}
+		esc.ends = append(esc.ends, len(esc.actions))
+	}
+	return esc
+}
+
+// escalated records the due escalation steps, whose actions were performed
+// starting at the given index of all the run's actions, as performed in the
+// alert's state. Steps are performed in order, so recording stops at the first
+// step any action of which failed, it's then retried on the next run
+func (a Alert) escalated(esc dueEscalation, offset int, failed []ActionError, kv logrus.Fields) {
+	if len(esc.ends) == 0 {
+		return
+	}
+
+	performed := len(esc.ends)
+	for _, f := range failed {
+		if f.Index < offset {
+			continue
+		}
+		for i, end := range esc.ends {
+			if f.Index-offset < end && i < performed {
+				performed = i
+			}
+		}
+	}
+
+	state.Update(a.Name, func(s *state.State) {
+		// another run may have escalated the alert in the meantime
+		if s.Escalated != esc.from {
+			return
+		}
+		s.Escalated += performed
+	})
+	for i := 0; i < performed; i++ {
+		log.LogAccess.WithFields(kv).WithField("step", esc.from+i).Infoln("escalated alert")
+	}
+	if performed < len(esc.ends) {
+		log.LogError.WithFields(kv).WithField("step", esc.from+performed).Errorln("failed to escalate alert, retrying on the next run")
+	}
+}
@@ -0,0 +1,60 @@
+package alert
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tengattack/esalert/search"
+	"github.com/tengattack/esalert/state"
+)
+
+// FlapDetection marks an alert as flapping when it changes between firing and
+// resolved more than Threshold times within Window. While flapping the
+// alert's notifications are suppressed, apart from a single notice. The alert
+// stops flapping once it changed no more than half of Threshold times within
+// Window
+type FlapDetection struct {
+	// Window is a duration string, e.g. "1h"
+	Window    string `yaml:"window"`
+	Threshold int    `yaml:"threshold"`
+	// Actions are performed as the notice that the alert is flapping,
+	// defaults to the alert's own actions
+	Actions []search.Dict `yaml:"actions"`
+
+	window  time.Duration
+	actions []interface{}
+}
+
+func (f *FlapDetection) init() error {
+	var err error
+	if f.window, err = time.ParseDuration(f.Window); err != nil {
+		return fmt.Errorf("parsing window: %s", err)
+	}
+	if f.window <= 0 || f.Threshold < 1 {
+		return errors.New("window and threshold must be positive")
+	}
+	f.actions, err = staticActionDefs(f.Actions)
+	return err
+}
+
+// update updates whether the alert is flapping, after its latest run was
+// recorded in s. A nil FlapDetection means the alert never flaps
+func (f *FlapDetection) update(s *state.State, now time.Time) {
+	if f == nil {
+		s.Flapping, s.FlapNotified = false, false
+		return
+	}
+
+	n := 0
+	for _, t := range s.Transitions {
+		if now.Sub(t) < f.window {
+			n++
+		}
+	}
+	if !s.Flapping && n > f.Threshold {
+		s.Flapping = true
+	} else if s.Flapping && n <= f.Threshold/2 {
+		s.Flapping, s.FlapNotified = false, false
+	}
+}
@@ -0,0 +1,183 @@
+package alert
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tengattack/esalert/action"
+	"github.com/tengattack/esalert/context"
+	"github.com/tengattack/esalert/route"
+	"github.com/tengattack/tgo/log"
+)
+
+type groupKey struct {
+	receiver string
+	key      string
+}
+
+// notificationGroup is a set of notifications buffered for a receiver, which
+// are sent together once its timer fires
+type notificationGroup struct {
+	notifications []context.Context
+}
+
+var groups = struct {
+	sync.Mutex
+	m map[groupKey]*notificationGroup
+}{m: map[groupKey]*notificationGroup{}}
+
+// groupNotification buffers the notification for the named receiver, in the
+// group of notifications sharing its values of the grouping's labels
+func groupNotification(receiver string, g route.Grouping, c context.Context) {
+	labels := notificationLabels(c)
+	parts := make([]string, len(g.By))
+	for i, l := range g.By {
+		parts[i] = fmt.Sprintf("%s=%q", l, labels[l])
+	}
+	key := groupKey{receiver: receiver, key: strings.Join(parts, ",")}
+
+	groups.Lock()
+	defer groups.Unlock()
+	if ng, ok := groups.m[key]; ok {
+		ng.notifications = append(ng.notifications, c)
+		return
+	}
+	groups.m[key] = &notificationGroup{notifications: []context.Context{c}}
+
+	wait := g.Wait
+	if g.DigestInterval > 0 {
+		now := time.Now()
+		wait = now.Truncate(g.DigestInterval).Add(g.DigestInterval).Sub(now)
+	}
+	log.LogAccess.WithFields(logrus.Fields{
+		"receiver": receiver,
+		"group":    key.key,
+		"wait":     wait,
+	}).Debugln("buffering notification group")
+	time.AfterFunc(wait, func() { flushGroup(key) })
+}
+
+func flushGroup(key groupKey) {
+	groups.Lock()
+	ng := groups.m[key]
+	delete(groups.m, key)
+	groups.Unlock()
+	if ng == nil {
+		return
+	}
+
+	kv := logrus.Fields{
+		"receiver":      key.receiver,
+		"group":         key.key,
+		"notifications": len(ng.notifications),
+	}
+	log.LogAccess.WithFields(kv).Infoln("sending notification group")
+
+	actionsRaw := mergeActions(route.Actions(key.receiver), ng.notifications, kv)
+	failed := performActions("group:"+key.receiver, 0, ng.notifications[0], actionsRaw)
+	if len(failed) > 0 {
+		kv["failed"] = failed
+		log.LogError.WithFields(kv).Errorf("%d of %d actions failed", len(failed), len(actionsRaw))
+	}
+}
+
+// mergedFields are the action fields which may differ between the
+// notifications of a group, they contain the message being sent
+var mergedFields = map[string]bool{
+	"message": true,
+	"text":    true,
+}
+
+// mergeActions renders every one of the receiver's actions against each of
+// the notifications, and merges the results: the values of the message and
+// text fields are joined by newlines, in the order the notifications were
+// buffered, duplicate values being dropped. Every other field can't be merged,
+// so the notifications are split by their values of those fields, and an
+// action is sent for each split
+func mergeActions(defs []interface{}, notifications []context.Context, kv logrus.Fields) []interface{} {
+	var res []interface{}
+	for _, def := range defs {
+		var rendered []map[string]interface{}
+		for _, c := range notifications {
+			r := def
+			if action.Templated(def) {
+				var err error
+				if r, err = action.Render(def, c); err != nil {
+					kv["name"] = c.Name
+					kv["err"] = err
+					log.LogError.WithFields(kv).Errorln("error rendering action")
+					continue
+				}
+			}
+			if m, ok := r.(map[string]interface{}); ok {
+				rendered = append(rendered, m)
+			}
+		}
+
+		for _, split := range splitRendered(rendered) {
+			res = append(res, mergeRendered(split))
+		}
+	}
+	return res
+}
+
+// splitRendered splits the rendered actions into the sets of actions whose
+// fields, other than the merged ones, are all the same, keeping their order
+func splitRendered(rendered []map[string]interface{}) [][]map[string]interface{} {
+	var splits [][]map[string]interface{}
+outer:
+	for _, r := range rendered {
+		for i := range splits {
+			if sameUnmerged(splits[i][0], r) {
+				splits[i] = append(splits[i], r)
+				continue outer
+			}
+		}
+		splits = append(splits, []map[string]interface{}{r})
+	}
+	return splits
+}
+
+// sameUnmerged returns whether all fields of the actions, other than the
+// merged ones, are the same
+func sameUnmerged(a, b map[string]interface{}) bool {
+	for _, m := range []map[string]interface{}{a, b} {
+		for k := range m {
+			if !mergedFields[k] && !reflect.DeepEqual(a[k], b[k]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// mergeRendered merges the rendered actions, whose unmerged fields are the
+// same, into a single action
+func mergeRendered(rendered []map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(rendered[0]))
+	for k, v := range rendered[0] {
+		merged[k] = v
+	}
+	for k, v := range merged {
+		if _, ok := v.(string); !ok || !mergedFields[k] {
+			continue
+		}
+		var values []string
+		seen := map[string]bool{}
+		for _, r := range rendered {
+			s, _ := r[k].(string)
+			if !seen[s] {
+				seen[s] = true
+				values = append(values, s)
+			}
+		}
+		merged[k] = strings.Join(values, "\n")
+	}
+	// the merged action is already rendered
+	merged["template"] = false
+	return merged
+}
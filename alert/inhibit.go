@@ -0,0 +1,95 @@
+package alert
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/tengattack/esalert/state"
+)
+
+// Inhibitor selects other alerts which, while firing, suppress an alert's
+// actions. It selects the alert named Alert, and/or the alerts whose labels
+// (including alertname and severity) match all of Match and MatchRE. In yaml
+// it may also be given as just the name of an alert
+type Inhibitor struct {
+	Alert   string            `yaml:"alert"`
+	Match   map[string]string `yaml:"match"`
+	MatchRE map[string]string `yaml:"match_re"`
+
+	matchRE map[string]*regexp.Regexp
+}
+
+// UnmarshalYAML allows the Inhibitor to be unmarshaled from either a string,
+// the name of the alert, or an object
+func (i *Inhibitor) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err == nil {
+		*i = Inhibitor{Alert: name}
+		return nil
+	}
+	type plain Inhibitor
+	return unmarshal((*plain)(i))
+}
+
+func (i *Inhibitor) init() error {
+	if i.Alert == "" && len(i.Match) == 0 && len(i.MatchRE) == 0 {
+		return errors.New("inhibitor without alert or matchers")
+	}
+	i.matchRE = make(map[string]*regexp.Regexp, len(i.MatchRE))
+	for k, v := range i.MatchRE {
+		re, err := regexp.Compile("^(?:" + v + ")$")
+		if err != nil {
+			return fmt.Errorf("match_re %s: %s", k, err)
+		}
+		i.matchRE[k] = re
+	}
+	return nil
+}
+
+func (i *Inhibitor) matches(s state.State) bool {
+	if i.Alert != "" && s.Name != i.Alert {
+		return false
+	}
+	for k, v := range i.Match {
+		if s.Labels[k] != v {
+			return false
+		}
+	}
+	for k, re := range i.matchRE {
+		if !re.MatchString(s.Labels[k]) {
+			return false
+		}
+	}
+	return true
+}
+
+// inhibitedBy returns the name of a firing alert which inhibits the alert, if
+// any
+func (a Alert) inhibitedBy() (string, bool) {
+	if len(a.InhibitedBy) == 0 {
+		return "", false
+	}
+	for _, s := range state.List() {
+		if s.Name == a.Name || !s.Firing {
+			continue
+		}
+		for i := range a.InhibitedBy {
+			if a.InhibitedBy[i].matches(s) {
+				return s.Name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// failingDependency returns the name of a firing alert the alert depends on,
+// if any
+func (a Alert) failingDependency() (string, bool) {
+	for _, name := range a.DependsOn {
+		if state.Get(name).Firing {
+			return name, true
+		}
+	}
+	return "", false
+}
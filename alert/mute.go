@@ -0,0 +1,223 @@
+package alert
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MuteWindow is a recurring period of time during which an alert's actions
+// are suppressed. It's either a cron expression, in which case every minute
+// matched by it is muted, or an optional list of weekdays with a start and end
+// time of day. A time range whose end isn't after its start runs past
+// midnight, the weekdays applying to the day it starts on
+type MuteWindow struct {
+	Cron     string   `yaml:"cron"`
+	Weekdays []string `yaml:"weekdays"`
+	Start    string   `yaml:"start"`
+	End      string   `yaml:"end"`
+	// Timezone is an IANA timezone name, e.g. "Asia/Shanghai", defaults to
+	// the local timezone
+	Timezone string `yaml:"timezone"`
+
+	loc        *time.Location
+	cron       []cronField // minute, hour, day of month, month, day of week
+	weekdays   [7]bool
+	start, end int // minutes since midnight
+
+	// cronDayOr is set if both the day of month and day of week fields are
+	// restricted, a day then matches if either of them does
+	cronDayOr bool
+}
+
+// parseWeekday parses a weekday's full or 3 letter name
+func parseWeekday(s string) (time.Weekday, bool) {
+	s = strings.ToLower(s)
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if full := strings.ToLower(d.String()); s == full || s == full[:3] {
+			return d, true
+		}
+	}
+	return 0, false
+}
+
+func (w *MuteWindow) init() error {
+	w.loc = time.Local
+	if w.Timezone != "" {
+		loc, err := time.LoadLocation(w.Timezone)
+		if err != nil {
+			return err
+		}
+		w.loc = loc
+	}
+
+	if w.Cron != "" {
+		if len(w.Weekdays) > 0 || w.Start != "" || w.End != "" {
+			return errors.New("cron can't be combined with weekdays, start or end")
+		}
+		var err error
+		if w.cron, err = parseCron(w.Cron); err != nil {
+			return err
+		}
+		// like in cron, a field starting with "*" isn't restricted
+		parts := strings.Fields(w.Cron)
+		w.cronDayOr = !strings.HasPrefix(parts[2], "*") && !strings.HasPrefix(parts[4], "*")
+		return nil
+	}
+
+	if w.Start == "" || w.End == "" {
+		return errors.New("either cron or start and end must be set")
+	}
+	var err error
+	if w.start, err = parseTimeOfDay(w.Start); err != nil {
+		return err
+	}
+	if w.end, err = parseTimeOfDay(w.End); err != nil {
+		return err
+	}
+
+	w.weekdays = [7]bool{}
+	for _, name := range w.Weekdays {
+		d, ok := parseWeekday(name)
+		if !ok {
+			return fmt.Errorf("unknown weekday %q", name)
+		}
+		w.weekdays[d] = true
+	}
+	if len(w.Weekdays) == 0 {
+		for d := range w.weekdays {
+			w.weekdays[d] = true
+		}
+	}
+	return nil
+}
+
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Contains returns whether the given time falls within the window
+func (w *MuteWindow) Contains(t time.Time) bool {
+	t = t.In(w.loc)
+	if w.cron != nil {
+		dom, dow := w.cron[2].matches(t.Day()), w.cron[4].matches(int(t.Weekday()))
+		day := dom && dow
+		if w.cronDayOr {
+			day = dom || dow
+		}
+		return day &&
+			w.cron[0].matches(t.Minute()) &&
+			w.cron[1].matches(t.Hour()) &&
+			w.cron[3].matches(int(t.Month()))
+	}
+
+	m := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return w.weekdays[t.Weekday()] && m >= w.start && m < w.end
+	}
+	// the range runs past midnight
+	if m >= w.start {
+		return w.weekdays[t.Weekday()]
+	}
+	return m < w.end && w.weekdays[(t.Weekday()+6)%7]
+}
+
+// cronField is the set of values matched by a single field of a cron
+// expression
+type cronField map[int]bool
+
+func (f cronField) matches(v int) bool {
+	return f[v]
+}
+
+var cronBounds = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+// parseCron parses a standard 5 field cron expression. Each field is a comma
+// separated list of "*", values or ranges, optionally with a "/step". Days of
+// the week may also be given by name, 7 being sunday like 0
+func parseCron(s string) ([]cronField, error) {
+	parts := strings.Fields(s)
+	if len(parts) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields", s)
+	}
+	fields := make([]cronField, 5)
+	for i, part := range parts {
+		f, err := parseCronField(part, cronBounds[i][0], cronBounds[i][1], i == 4)
+		if err != nil {
+			return nil, fmt.Errorf("cron expression %q: %s", s, err)
+		}
+		fields[i] = f
+	}
+	if fields[4][7] {
+		fields[4][0] = true
+	}
+	return fields, nil
+}
+
+func parseCronField(s string, lo, hi int, weekday bool) (cronField, error) {
+	f := cronField{}
+	for _, item := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(item[i+1:]); err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid step in %q", item)
+			}
+			item = item[:i]
+		}
+
+		from, to := lo, hi
+		if item != "*" {
+			bounds := strings.SplitN(item, "-", 2)
+			var err error
+			if from, err = cronValue(bounds[0], weekday); err != nil {
+				return nil, err
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = cronValue(bounds[1], weekday); err != nil {
+					return nil, err
+				}
+			} else if step > 1 {
+				to = hi
+			}
+		}
+		if from < lo || to > hi || from > to {
+			return nil, fmt.Errorf("%q out of range %d-%d", item, lo, hi)
+		}
+		for v := from; v <= to; v += step {
+			f[v] = true
+		}
+	}
+	return f, nil
+}
+
+func cronValue(s string, weekday bool) (int, error) {
+	if weekday {
+		if d, ok := parseWeekday(s); ok {
+			return int(d), nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	return v, nil
+}
+
+// muted returns whether the given time falls within any of the alert's mute
+// windows
+func (a Alert) muted(t time.Time) bool {
+	for i := range a.MuteDuring {
+		if a.MuteDuring[i].Contains(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,245 @@
+// Package api implements esalert's management http api
+package api
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tengattack/esalert/ack"
+	"github.com/tengattack/esalert/queue"
+	"github.com/tengattack/esalert/silence"
+	"github.com/tengattack/esalert/state"
+	"github.com/tengattack/tgo/log"
+)
+
+// Handler returns the http.Handler serving all of the api's endpoints
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/queue", queueHandler)
+	mux.HandleFunc("/alerts", alertsHandler)
+	mux.HandleFunc("/silences", silencesHandler)
+	mux.HandleFunc("/silences/", silenceHandler)
+	mux.HandleFunc(ack.Path, ackHandler)
+	return mux
+}
+
+// Serve serves the api on the given address, it only returns if there was an
+// error
+func Serve(addr string) error {
+	log.LogAccess.WithFields(logrus.Fields{
+		"addr": addr,
+	}).Infoln("serving management api")
+	return http.ListenAndServe(addr, Handler())
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.LogError.WithFields(logrus.Fields{
+			"err": err,
+		}).Errorln("failed to write api response")
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
+
+// authorized returns whether the request has the ack secret as a bearer token,
+// which the endpoints changing esalert's state require. If not it writes an
+// error response
+func authorized(w http.ResponseWriter, r *http.Request) bool {
+	if err := ack.VerifyToken(r.Header.Get("Authorization")); err != nil {
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return false
+	}
+	return true
+}
+
+type queueStats struct {
+	Enabled          bool    `json:"enabled"`
+	Depth            int     `json:"depth"`
+	OldestAge        string  `json:"oldest_age"`
+	OldestAgeSeconds float64 `json:"oldest_age_seconds"`
+	DeadLetters      int     `json:"dead_letters"`
+}
+
+func queueHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if queue.Default == nil {
+		writeJSON(w, http.StatusOK, queueStats{})
+		return
+	}
+
+	s := queue.Default.Stats()
+	writeJSON(w, http.StatusOK, queueStats{
+		Enabled:          true,
+		Depth:            s.Depth,
+		OldestAge:        s.OldestAge.String(),
+		OldestAgeSeconds: s.OldestAge.Seconds(),
+		DeadLetters:      s.DeadLetters,
+	})
+}
+
+func alertsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, state.List())
+}
+
+func silencesHandler(w http.ResponseWriter, r *http.Request) {
+	if silence.Default == nil {
+		writeError(w, http.StatusNotFound, "silences are not enabled")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, silence.Default.List())
+	case http.MethodPost:
+		if !authorized(w, r) {
+			return
+		}
+		var sl silence.Silence
+		if err := json.NewDecoder(r.Body).Decode(&sl); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid silence: "+err.Error())
+			return
+		}
+		sl, err := silence.Default.Add(sl)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		log.LogAccess.WithFields(logrus.Fields{
+			"silence":   sl.ID,
+			"createdBy": sl.CreatedBy,
+			"endsAt":    sl.EndsAt,
+		}).Infoln("silence added")
+		writeJSON(w, http.StatusCreated, sl)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func silenceHandler(w http.ResponseWriter, r *http.Request) {
+	if silence.Default == nil {
+		writeError(w, http.StatusNotFound, "silences are not enabled")
+		return
+	}
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !authorized(w, r) {
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/silences/")
+	ok, err := silence.Default.Expire(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	} else if !ok {
+		writeError(w, http.StatusNotFound, "silence not found")
+		return
+	}
+	log.LogAccess.WithFields(logrus.Fields{
+		"silence": id,
+	}).Infoln("silence expired")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ackPage is the page served for acknowledgement links. Opening a link only
+// shows it, since link previews and mail scanners fetch every link in a
+// message, the alert is acknowledged by submitting its form
+var ackPage = template.Must(template.New("ack").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Acknowledge {{.Alert}}</title></head>
+<body>
+{{if .Acknowledged}}<p>Alert <b>{{.Alert}}</b> is acknowledged until it resolves.</p>
+{{else}}<p>Acknowledge alert <b>{{.Alert}}</b>? Its notifications are suppressed until it resolves.</p>
+<form method="post"><button type="submit">Acknowledge</button></form>
+{{end}}</body>
+</html>
+`))
+
+func writeAckPage(w http.ResponseWriter, name string, acknowledged bool) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := ackPage.Execute(w, map[string]interface{}{"Alert": name, "Acknowledged": acknowledged})
+	if err != nil {
+		log.LogError.WithFields(logrus.Fields{
+			"err": err,
+		}).Errorln("failed to write api response")
+	}
+}
+
+// ackHandler acknowledges an alert, either through a signed link (see
+// ackLink) or the api (POST, with a json body like {"alert":"name"} and the
+// ack secret as a bearer token)
+func ackHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if r.Method == http.MethodGet || q.Get("sig") != "" {
+		ackLink(w, r, q)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !authorized(w, r) {
+		return
+	}
+
+	var body struct {
+		Alert string `json:"alert"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Alert == "" {
+		writeError(w, http.StatusBadRequest, "invalid body, expected {\"alert\":\"name\"}")
+		return
+	}
+	if !state.Acknowledge(body.Alert) {
+		writeError(w, http.StatusNotFound, "alert is not firing")
+		return
+	}
+	log.LogAccess.WithFields(logrus.Fields{
+		"name": body.Alert,
+	}).Infoln("alert acknowledged")
+	writeJSON(w, http.StatusOK, map[string]interface{}{"alert": body.Alert, "acknowledged": true})
+}
+
+// ackLink serves an acknowledgement link. Opening it (GET) only shows a
+// confirmation page, whose form POSTs back to the link to acknowledge the
+// alert
+func ackLink(w http.ResponseWriter, r *http.Request, q url.Values) {
+	name, err := ack.Verify(q)
+	if err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeAckPage(w, name, false)
+	case http.MethodPost:
+		if !state.Acknowledge(name) {
+			writeError(w, http.StatusNotFound, "alert is not firing")
+			return
+		}
+		log.LogAccess.WithFields(logrus.Fields{
+			"name": name,
+		}).Infoln("alert acknowledged through link")
+		writeAckPage(w, name, true)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,72 @@
+package api_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tengattack/esalert/api"
+	"github.com/tengattack/esalert/config"
+	"github.com/tengattack/esalert/silence"
+)
+
+func TestSilences(t *testing.T) {
+	dir, err := ioutil.TempDir("", "esalert-api")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	silence.Default, err = silence.Open(filepath.Join(dir, "silences.json"))
+	require.Nil(t, err)
+	defer func() { silence.Default = nil }()
+	config.Opts.AckSecret = "s3cret"
+	defer func() { config.Opts.AckSecret = "" }()
+
+	s := httptest.NewServer(api.Handler())
+	defer s.Close()
+	do := func(method, path, token, body string) *http.Response {
+		req, err := http.NewRequest(method, s.URL+path, strings.NewReader(body))
+		require.Nil(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		return resp
+	}
+
+	// changing silences requires the secret as a bearer token
+	body := `{"matchers":[{"name":"alertname","value":"wat"}],"ends_at":"2100-01-01T00:00:00Z","created_by":"me"}`
+	resp := do(http.MethodPost, "/silences", "", body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp = do(http.MethodPost, "/silences", "nope", body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Empty(t, silence.Default.List())
+
+	resp = do(http.MethodPost, "/silences", "s3cret", body)
+	var sl silence.Silence
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&sl))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp = do(http.MethodDelete, "/silences/"+sl.ID, "", "")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Len(t, silence.Default.List(), 1)
+	resp = do(http.MethodDelete, "/silences/"+sl.ID, "s3cret", "")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Empty(t, silence.Default.List())
+
+	// reading them doesn't
+	resp = do(http.MethodGet, "/silences", "", "")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
@@ -3,12 +3,22 @@ package main
 import (
 	"io/ioutil"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/tengattack/esalert/action"
 	"github.com/tengattack/esalert/alert"
+	"github.com/tengattack/esalert/api"
 	"github.com/tengattack/esalert/config"
+	"github.com/tengattack/esalert/luautil"
+	"github.com/tengattack/esalert/queue"
+	"github.com/tengattack/esalert/route"
+	"github.com/tengattack/esalert/silence"
+	"github.com/tengattack/esalert/state"
+	"github.com/tengattack/esalert/store"
 	"github.com/tengattack/tgo/log"
 	yaml "gopkg.in/yaml.v2"
 )
@@ -20,6 +30,70 @@ var (
 
 func main() {
 	log.LogAccess.Infof("starting esalert %s", Version)
+
+	if err := route.Load(config.Opts.Receivers, config.Opts.Route); err != nil {
+		log.LogError.WithFields(logrus.Fields{
+			"err": err,
+		}).Fatalln("failed loading receivers and routes")
+	}
+
+	if err := luautil.CheckPath(); err != nil {
+		log.LogError.WithFields(logrus.Fields{
+			"err": err,
+		}).Fatalln("failed checking lua path")
+	}
+
+	if config.Opts.QueueDir != "" {
+		q, err := queue.Open(config.Opts.QueueDir, queue.Deliver)
+		if err != nil {
+			log.LogError.WithFields(logrus.Fields{
+				"err": err,
+			}).Fatalln("failed opening action queue")
+		}
+		q.Retry = action.RetryPolicy{
+			MaxAttempts: config.Opts.QueueMaxAttempts,
+			Backoff:     config.Opts.QueueRetryBackoff,
+			MaxBackoff:  config.Opts.QueueMaxRetryBackoff,
+		}
+		q.Start(config.Opts.QueueWorkers)
+		queue.Default = q
+	}
+
+	if config.Opts.StateFile != "" {
+		if err := state.Open(config.Opts.StateFile); err != nil {
+			log.LogError.WithFields(logrus.Fields{
+				"err": err,
+			}).Fatalln("failed loading alert state")
+		}
+	}
+
+	// opened even without a file, so expired keys are dropped
+	if err := store.Open(config.Opts.StoreFile); err != nil {
+		log.LogError.WithFields(logrus.Fields{
+			"err": err,
+		}).Fatalln("failed loading store")
+	}
+
+	if config.Opts.SilenceFile != "" {
+		s, err := silence.Open(config.Opts.SilenceFile)
+		if err != nil {
+			log.LogError.WithFields(logrus.Fields{
+				"err": err,
+			}).Fatalln("failed loading silences")
+		}
+		silence.Default = s
+	}
+
+	if config.Opts.APIAddr != "" {
+		go func() {
+			if err := api.Serve(config.Opts.APIAddr); err != nil {
+				log.LogError.WithFields(logrus.Fields{
+					"err": err,
+				}).Fatalln("failed serving management api")
+			}
+		}()
+	}
+
 	fstat, err := os.Stat(config.Opts.AlertFileDir)
 	if err != nil {
 		log.LogError.WithFields(logrus.Fields{
@@ -85,7 +159,13 @@ func main() {
 		os.Exit(1)
 	}
 
-	select {}
+	// write the pending changes of the state and store before exiting
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	<-sigCh
+	log.LogAccess.Infoln("shutting down")
+	state.Flush()
+	store.Flush()
 }
 
 func alertSpin(a alert.Alert) {
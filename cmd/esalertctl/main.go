@@ -0,0 +1,200 @@
+// Command esalertctl manages a running esalert through its management api
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tengattack/esalert/silence"
+)
+
+const usage = `Usage: esalertctl [-api URL] <command> [args]
+
+Commands:
+  silence add [-author NAME] [-comment TEXT] [-start TIME] (-duration DURATION | -end TIME) MATCHER...
+        add a silence, matchers are name=value or name=~regex, e.g. alertname=foo
+  silence list
+        list the silences which haven't ended
+  silence expire ID
+        expire a silence
+
+Times are RFC3339, e.g. 2006-01-02T15:04:05+08:00.
+`
+
+var apiURL string
+
+func main() {
+	flag.StringVar(&apiURL, "api", "http://127.0.0.1:8080", "Address of esalert's management api")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 2 || args[0] != "silence" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch args[1] {
+	case "add":
+		err = silenceAdd(args[2:])
+	case "list":
+		err = silenceList()
+	case "expire":
+		if len(args) != 3 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		err = silenceExpire(args[2])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "esalertctl:", err)
+		os.Exit(1)
+	}
+}
+
+// parseMatcher parses a name=value or name=~regex matcher
+func parseMatcher(s string) (silence.Matcher, error) {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return silence.Matcher{}, fmt.Errorf("invalid matcher %q", s)
+	}
+	m := silence.Matcher{Name: s[:i], Value: s[i+1:]}
+	if strings.HasPrefix(m.Value, "~") {
+		m.Value = m.Value[1:]
+		m.IsRegex = true
+	}
+	return m, nil
+}
+
+func silenceAdd(args []string) error {
+	fs := flag.NewFlagSet("silence add", flag.ExitOnError)
+	author := fs.String("author", os.Getenv("USER"), "Who is creating the silence")
+	comment := fs.String("comment", "", "Why the silence is created")
+	start := fs.String("start", "", "When the silence starts, defaults to now")
+	end := fs.String("end", "", "When the silence ends")
+	duration := fs.Duration("duration", 0, "How long the silence lasts, instead of -end")
+	fs.Parse(args)
+
+	sl := silence.Silence{
+		CreatedBy: *author,
+		Comment:   *comment,
+	}
+	for _, arg := range fs.Args() {
+		m, err := parseMatcher(arg)
+		if err != nil {
+			return err
+		}
+		sl.Matchers = append(sl.Matchers, m)
+	}
+
+	var err error
+	if *start != "" {
+		if sl.StartsAt, err = time.Parse(time.RFC3339, *start); err != nil {
+			return err
+		}
+	}
+	switch {
+	case *end != "" && *duration != 0:
+		return errors.New("only one of -end and -duration may be set")
+	case *end != "":
+		if sl.EndsAt, err = time.Parse(time.RFC3339, *end); err != nil {
+			return err
+		}
+	case *duration != 0:
+		sl.EndsAt = sl.StartsAt
+		if sl.EndsAt.IsZero() {
+			sl.EndsAt = time.Now()
+		}
+		sl.EndsAt = sl.EndsAt.Add(*duration)
+	default:
+		return errors.New("one of -end and -duration must be set")
+	}
+
+	body, err := json.Marshal(sl)
+	if err != nil {
+		return err
+	}
+	if err := do(http.MethodPost, "/silences", body, &sl); err != nil {
+		return err
+	}
+	fmt.Println(sl.ID)
+	return nil
+}
+
+func silenceList() error {
+	var silences []silence.Silence
+	if err := do(http.MethodGet, "/silences", nil, &silences); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tMATCHERS\tSTARTS\tENDS\tCREATED BY\tCOMMENT")
+	for _, sl := range silences {
+		matchers := make([]string, len(sl.Matchers))
+		for i, m := range sl.Matchers {
+			op := "="
+			if m.IsRegex {
+				op = "=~"
+			}
+			matchers[i] = m.Name + op + m.Value
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", sl.ID, strings.Join(matchers, " "),
+			sl.StartsAt.Format(time.RFC3339), sl.EndsAt.Format(time.RFC3339), sl.CreatedBy, sl.Comment)
+	}
+	return w.Flush()
+}
+
+func silenceExpire(id string) error {
+	return do(http.MethodDelete, "/silences/"+id, nil, nil)
+}
+
+// do performs a request against the api, decoding the json response into
+// res if it's not nil
+func do(method, path string, body []byte, res interface{}) error {
+	req, err := http.NewRequest(method, strings.TrimRight(apiURL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(b, &apiErr) == nil && apiErr.Error != "" {
+			return errors.New(apiErr.Error)
+		}
+		return fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	if res == nil {
+		return nil
+	}
+	return json.Unmarshal(b, res)
+}
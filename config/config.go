@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"path"
 	"runtime"
+	"time"
 
 	"gopkg.in/yaml.v2"
 
@@ -14,18 +15,91 @@ import (
 	"github.com/tengattack/tgo/log"
 )
 
+// Receiver is a named list of action definitions, which notifications routed
+// to it are sent with
+type Receiver struct {
+	Name    string                   `yaml:"name"`
+	Actions []map[string]interface{} `yaml:"actions"`
+	// GroupBy, GroupWait and DigestInterval group the notifications sent to
+	// the receiver, see the route package
+	GroupBy        []string `yaml:"group_by"`
+	GroupWait      string   `yaml:"group_wait"`
+	DigestInterval string   `yaml:"digest_interval"`
+}
+
+// Route is a node of the notification routing tree. A notification matches a
+// route if all of its Match labels are equal, and all of its MatchRE labels
+// match the regular expressions
+type Route struct {
+	Receiver string            `yaml:"receiver"`
+	Match    map[string]string `yaml:"match"`
+	MatchRE  map[string]string `yaml:"match_re"`
+	Continue bool              `yaml:"continue"`
+	Routes   []Route           `yaml:"routes"`
+}
+
+// LuaSandbox is a named profile restricting what the lua code run in it may
+// access
+type LuaSandbox struct {
+	Name string `yaml:"name"`
+	// Deny lists globals and modules which can't be used, e.g. "os" or
+	// "socket" (which also denies its submodules, like "socket.http")
+	Deny []string `yaml:"deny"`
+	// Timeout overrides lua-timeout for runs in the sandbox
+	Timeout time.Duration `yaml:"timeout"`
+}
+
 // Opts configs
 var Opts struct {
-	Conf              string     `long:"conf" description:"esalert config file"`
-	AlertFileDir      string     `yaml:"alerts" long:"alerts" short:"a" required:"true" description:"A yaml file, or directory with yaml files, containing alert definitions"`
-	ElasticSearchAddr string     `yaml:"es-addr" long:"es-addr" default:"127.0.0.1:9200" description:"Address to find an elasticsearch instance on"`
-	ElasticSearchUser string     `yaml:"es-user" long:"es-user" default:"elastic" description:"Username for the elasticsearch"`
-	ElasticSearchPass string     `yaml:"es-pass" long:"es-pass" default:"changeme" description:"Password for the elasticsearch"`
-	LuaInit           string     `yaml:"lua-init" long:"lua-init" description:"If set the given lua script file will be executed at the initialization of every lua vm"`
-	LuaVMs            int        `yaml:"lua-vms" long:"lua-vms" default:"1" description:"How many lua vms should be used. Each vm is completely independent of the other, and requests are executed on whatever vm is available at that moment. Allows lua scripts to not all be blocked on the same os thread"`
-	SlackWebhook      string     `yaml:"slack-webhook" long:"slack-webhook" description:"Slack webhook url, required if using any Slack actions"`
-	ForceRun          string     `yaml:"force-run" long:"force-run" description:"If set with the name of an alert, will immediately run that alert and exit. Useful for testing changes to alert definitions"`
-	Log               log.Config `yaml:"log" long:"log" description:"logging options"`
+	Conf                       string        `long:"conf" description:"esalert config file"`
+	AlertFileDir               string        `yaml:"alerts" long:"alerts" short:"a" required:"true" description:"A yaml file, or directory with yaml files, containing alert definitions"`
+	ElasticSearchAddr          string        `yaml:"es-addr" long:"es-addr" default:"127.0.0.1:9200" description:"Address to find an elasticsearch instance on"`
+	ElasticSearchUser          string        `yaml:"es-user" long:"es-user" default:"elastic" description:"Username for the elasticsearch"`
+	ElasticSearchPass          string        `yaml:"es-pass" long:"es-pass" default:"changeme" description:"Password for the elasticsearch"`
+	ElasticSearchIndex         string        `yaml:"es-alert-index" long:"es-alert-index" default:"esalert" description:"Index elasticsearch actions write alert events into by default, may be a go template"`
+	ElasticSearchBulkSize      int           `yaml:"es-bulk-size" long:"es-bulk-size" default:"100" description:"Maximum number of documents elasticsearch actions write in a single bulk request"`
+	ElasticSearchFlushInterval time.Duration `yaml:"es-flush-interval" long:"es-flush-interval" default:"1s" description:"How long elasticsearch actions wait for other documents to batch with before writing them"`
+	LuaInit                    string        `yaml:"lua-init" long:"lua-init" description:"If set the given lua script file will be executed at the initialization of every lua vm"`
+	LuaPath                    []string      `yaml:"lua-path" long:"lua-path" description:"Directory lua modules can be required from, may be given multiple times. e.g. require(\"lib.thresholds\") loads lib/thresholds.lua in it"`
+	LuaVMs                     int           `yaml:"lua-vms" long:"lua-vms" default:"1" description:"How many lua vms should be used. Each vm is completely independent of the other, and requests are executed on whatever vm is available at that moment. Allows lua scripts to not all be blocked on the same os thread"`
+	LuaSandbox                 string        `yaml:"lua-sandbox" long:"lua-sandbox" description:"Sandbox profile lua code is run in, unless its alert sets another one. Either strict, or the name of one of lua-sandboxes. If not set lua code is unrestricted"`
+	LuaSandboxes               []LuaSandbox  `yaml:"lua-sandboxes" no-flag:"true"`
+	LuaTimeout                 time.Duration `yaml:"lua-timeout" long:"lua-timeout" default:"30s" description:"How long a single run of lua code may take before it's aborted and its alert fails. 0 means no limit"`
+	LuaCallStackSize           int           `yaml:"lua-call-stack-size" long:"lua-call-stack-size" default:"256" description:"Maximum depth of nested function calls in the lua vms"`
+	LuaRegistryMaxSize         int           `yaml:"lua-registry-max-size" long:"lua-registry-max-size" default:"262144" description:"Maximum number of values the stack of a lua vm may grow to"`
+	SlackWebhook               string        `yaml:"slack-webhook" long:"slack-webhook" description:"Slack webhook url, required if using any Slack actions"`
+	DingTalkWebhook            string        `yaml:"dingtalk-webhook" long:"dingtalk-webhook" description:"DingTalk robot webhook url, required if using any DingTalk actions"`
+	DingTalkSecret             string        `yaml:"dingtalk-secret" long:"dingtalk-secret" description:"DingTalk robot secret. If set the DingTalk webhook requests will be signed"`
+	WeComWebhook               string        `yaml:"wecom-webhook" long:"wecom-webhook" description:"WeCom group robot webhook url, required if using any WeCom actions"`
+	FeishuWebhook              string        `yaml:"feishu-webhook" long:"feishu-webhook" description:"Feishu/Lark custom bot webhook url, required if using any Feishu actions"`
+	FeishuSecret               string        `yaml:"feishu-secret" long:"feishu-secret" description:"Feishu/Lark custom bot secret. If set the Feishu webhook requests will be signed"`
+	TelegramBotToken           string        `yaml:"telegram-bot-token" long:"telegram-bot-token" description:"Telegram bot token, required if using any Telegram actions"`
+	TelegramAPIURL             string        `yaml:"telegram-api-url" long:"telegram-api-url" default:"https://api.telegram.org" description:"Base url of the Telegram Bot API"`
+	ExecAllow                  []string      `yaml:"exec-allow" long:"exec-allow" description:"Command exec actions are allowed to run, may be given multiple times. If not set no commands may be run"`
+	ExecEnvAllow               []string      `yaml:"exec-env-allow" long:"exec-env-allow" description:"Environment variable exec actions are allowed to set, may be given multiple times. If not set no variables may be set"`
+	ExecTimeout                time.Duration `yaml:"exec-timeout" long:"exec-timeout" default:"30s" description:"Default time after which commands run by exec actions are killed"`
+	AlertmanagerURL            string        `yaml:"alertmanager-url" long:"alertmanager-url" description:"Prometheus Alertmanager url, required if using any Alertmanager actions"`
+	AlertmanagerResolveTimeout time.Duration `yaml:"alertmanager-resolve-timeout" long:"alertmanager-resolve-timeout" default:"5m" description:"How long after being sent alerts are considered resolved by Alertmanager, should be longer than the intervals of the alerts using Alertmanager actions"`
+	KibanaURL                  string        `yaml:"kibana-url" long:"kibana-url" description:"Kibana url used as the generatorURL of alerts sent to Alertmanager, may be a go template"`
+	ActionConcurrency          int           `yaml:"action-concurrency" long:"action-concurrency" default:"16" description:"How many actions, across all alerts, may be performed at the same time. 0 means no limit"`
+	QueueDir                   string        `yaml:"queue-dir" long:"queue-dir" description:"If set actions are pushed into a durable queue kept in this directory, and performed by worker goroutines, instead of being performed directly"`
+	QueueWorkers               int           `yaml:"queue-workers" long:"queue-workers" default:"4" description:"How many worker goroutines perform queued actions"`
+	QueueMaxAttempts           int           `yaml:"queue-max-attempts" long:"queue-max-attempts" default:"10" description:"How many times a queued action is attempted before it's moved to the dead-letter file"`
+	QueueRetryBackoff          time.Duration `yaml:"queue-retry-backoff" long:"queue-retry-backoff" default:"10s" description:"How long to wait before retrying a failed queued action, doubled after every attempt"`
+	QueueMaxRetryBackoff       time.Duration `yaml:"queue-max-retry-backoff" long:"queue-max-retry-backoff" default:"10m" description:"Upper bound of the wait between retries of a failed queued action"`
+	APIAddr                    string        `yaml:"api-addr" long:"api-addr" description:"If set the management http api will listen on this address"`
+	SilenceFile                string        `yaml:"silence-file" long:"silence-file" description:"If set silences are enabled, and persisted to this file"`
+	StateFile                  string        `yaml:"state-file" long:"state-file" description:"If set the firing state of alerts, which escalations are driven by, is persisted to this file"`
+	StatePrevious              bool          `yaml:"state-previous" long:"state-previous" description:"If set the summary of the previous run of alerts, ctx.Previous, is persisted to the state-file too. Otherwise it's only kept in memory"`
+	SaveInterval               time.Duration `yaml:"save-interval" long:"save-interval" default:"10s" description:"How often changes are written to the state-file and store-file. They're also written on shutdown"`
+	StoreFile                  string        `yaml:"store-file" long:"store-file" description:"If set the key/value store of the lua store module is persisted to this file"`
+	AckURL                     string        `yaml:"ack-url" long:"ack-url" description:"Base url of the management api as reachable by users, e.g. https://esalert.example.com, used in acknowledgement links"`
+	AckSecret                  string        `yaml:"ack-secret" long:"ack-secret" description:"Secret acknowledgement links are signed with, required to use them"`
+	AckLinkTTL                 time.Duration `yaml:"ack-link-ttl" long:"ack-link-ttl" default:"24h" description:"How long acknowledgement links are valid for"`
+	Receivers                  []Receiver    `yaml:"receivers" no-flag:"true"`
+	Route                      Route         `yaml:"route" no-flag:"true"`
+	ForceRun                   string        `yaml:"force-run" long:"force-run" description:"If set with the name of an alert, will immediately run that alert and exit. Useful for testing changes to alert definitions"`
+	Log                        log.Config    `yaml:"log" long:"log" description:"logging options"`
 }
 
 func init() {
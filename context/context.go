@@ -4,6 +4,7 @@
 package context
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/tengattack/esalert/search"
@@ -14,6 +15,95 @@ import (
 type Context struct {
 	Name          string
 	StartedTS     uint64
+	Severity      string            // Set by the process step or the alert's severity
+	Labels        map[string]string // Set by the process step or the alert's labels
+	Acknowledged  bool              // Whether the alert was acknowledged since it started firing
+	AckURL        string            // Link acknowledging the alert, if ack links are enabled
+	Flapping      bool              // Whether the alert is flapping, see the alert's flap detection
+	Previous      *Previous         // Summary of the alert's previous run, nil on its first run
 	search.Result `luautil:",inline"`
 	time.Time     `luautil:"-"`
 }
+
+// Previous summarizes a previous run of an alert
+type Previous struct {
+	StartedTS    uint64
+	HitCount     uint64
+	Aggregations map[string]interface{}
+	// ProcessResult is what the process step returned, nil if it didn't run
+	ProcessResult interface{}
+}
+
+// jsonContext is the json representation of a Context, it uses the same field
+// names which are available in lua
+type jsonContext struct {
+	Name         string
+	StartedTS    uint64
+	Severity     string            `json:",omitempty"`
+	Labels       map[string]string `json:",omitempty"`
+	Acknowledged bool              `json:",omitempty"`
+	AckURL       string            `json:",omitempty"`
+	Flapping     bool              `json:",omitempty"`
+	Previous     *Previous         `json:",omitempty"`
+	Time         time.Time
+	TookMS       uint64
+	TimedOut     bool
+	HitCount     uint64
+	HitMaxScore  float64
+	Hits         []search.Hit
+	Aggregations map[string]interface{}
+}
+
+// MarshalJSON implements the json.Marshaler interface. Without it the
+// embedded time.Time's MarshalJSON would be used, and only the time would be
+// encoded
+func (c Context) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonContext{
+		Name:         c.Name,
+		StartedTS:    c.StartedTS,
+		Severity:     c.Severity,
+		Labels:       c.Labels,
+		Acknowledged: c.Acknowledged,
+		AckURL:       c.AckURL,
+		Flapping:     c.Flapping,
+		Previous:     c.Previous,
+		Time:         c.Time,
+		TookMS:       c.TookMS,
+		TimedOut:     c.TimedOut,
+		HitCount:     c.HitCount,
+		HitMaxScore:  c.HitMaxScore,
+		Hits:         c.Hits,
+		Aggregations: c.Aggregations,
+	})
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface, it's the inverse of
+// MarshalJSON
+func (c *Context) UnmarshalJSON(b []byte) error {
+	var jc jsonContext
+	if err := json.Unmarshal(b, &jc); err != nil {
+		return err
+	}
+	*c = Context{
+		Name:         jc.Name,
+		StartedTS:    jc.StartedTS,
+		Severity:     jc.Severity,
+		Labels:       jc.Labels,
+		Acknowledged: jc.Acknowledged,
+		AckURL:       jc.AckURL,
+		Flapping:     jc.Flapping,
+		Previous:     jc.Previous,
+		Result: search.Result{
+			TookMS:   jc.TookMS,
+			TimedOut: jc.TimedOut,
+			HitInfo: search.HitInfo{
+				HitCount:    jc.HitCount,
+				HitMaxScore: jc.HitMaxScore,
+				Hits:        jc.Hits,
+			},
+			Aggregations: jc.Aggregations,
+		},
+		Time: jc.Time,
+	}
+	return nil
+}
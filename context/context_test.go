@@ -0,0 +1,45 @@
+package context_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tengattack/esalert/context"
+	"github.com/tengattack/esalert/search"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	c := context.Context{
+		Name:         "foo",
+		StartedTS:    10,
+		Severity:     "critical",
+		Labels:       map[string]string{"team": "payments"},
+		Acknowledged: true,
+		AckURL:       "http://esalert/ack?alert=foo",
+		Flapping:     true,
+		Previous: &context.Previous{
+			StartedTS:     5,
+			HitCount:      3,
+			Aggregations:  map[string]interface{}{"max": 1.5},
+			ProcessResult: []interface{}{"a"},
+		},
+		Result: search.Result{
+			TookMS: 2,
+			HitInfo: search.HitInfo{
+				HitCount: 1,
+				Hits:     []search.Hit{{ID: "a", Source: map[string]interface{}{"host": "web1"}}},
+			},
+			Aggregations: map[string]interface{}{"count": 7.0},
+		},
+		Time: time.Unix(10, 0).UTC(),
+	}
+
+	b, err := json.Marshal(c)
+	require.Nil(t, err)
+	var c2 context.Context
+	require.Nil(t, json.Unmarshal(b, &c2))
+	assert.Equal(t, c, c2)
+}
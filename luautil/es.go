@@ -0,0 +1,131 @@
+package luautil
+
+import (
+	gocontext "context"
+	"encoding/json"
+
+	"github.com/tengattack/esalert/search"
+	lua "github.com/yuin/gopher-lua"
+)
+
+var esFuncs = map[string]lua.LGFunction{
+	"search":  esSearch,
+	"count":   esCount,
+	"msearch": esMSearch,
+}
+
+// esLoader loads the "es" module, which runs additional queries against the
+// same elasticsearch instance, and with the same credentials, as the search
+// step. Failed queries return nil and the error message
+func esLoader(l *lua.LState) int {
+	l.Push(l.SetFuncs(l.NewTable(), esFuncs))
+	return 1
+}
+
+// esBody converts the given lua value into a request body. Strings are taken
+// to already be json, tables are json encoded
+func esBody(l *lua.LState, v lua.LValue) interface{} {
+	switch v.Type() {
+	case lua.LTNil:
+		return nil
+	case lua.LTString:
+		return json.RawMessage(lua.LVAsString(v))
+	case lua.LTTable:
+		body := pullArbitraryValueInner(l, v)
+		// an empty table is pulled as an empty array, but means an empty object
+		if arr, ok := body.([]interface{}); ok && len(arr) == 0 {
+			return map[string]interface{}{}
+		}
+		return body
+	default:
+		l.RaiseError("request body must be a table or a json string, not %s", v.Type())
+		return nil
+	}
+}
+
+// runContext returns the context of the current run, which is done once the
+// run timed out
+func runContext(l *lua.LState) gocontext.Context {
+	if ctx := l.Context(); ctx != nil {
+		return ctx
+	}
+	return gocontext.Background()
+}
+
+func esError(l *lua.LState, err error) int {
+	l.Push(lua.LNil)
+	l.Push(lua.LString(err.Error()))
+	return 2
+}
+
+// es.search(index[, body]) returns the search result, which has the same
+// fields as ctx
+func esSearch(l *lua.LState) int {
+	index := l.CheckString(1)
+	body := esBody(l, l.Get(2))
+	if body == nil {
+		body = map[string]interface{}{}
+	}
+	res, err := search.SearchIndex(runContext(l), index, body)
+	if err != nil {
+		return esError(l, err)
+	}
+	l.Push(pushArbitraryValue(l, res))
+	return 1
+}
+
+// es.count(index[, body]) returns the number of documents matching the query
+func esCount(l *lua.LState) int {
+	index := l.CheckString(1)
+	n, err := search.Count(runContext(l), index, esBody(l, l.Get(2)))
+	if err != nil {
+		return esError(l, err)
+	}
+	l.Push(lua.LNumber(n))
+	return 1
+}
+
+// es.msearch(searches) performs a list of {index = ..., body = ...} searches
+// in a single request, and returns the list of their results. Searches which
+// failed have a table with only an error field in their place
+func esMSearch(l *lua.LState) int {
+	tb := l.CheckTable(1)
+	items := make([]search.MSearchItem, 0, tb.Len())
+	for i := 1; i <= tb.Len(); i++ {
+		s, ok := tb.RawGetInt(i).(*lua.LTable)
+		if !ok {
+			l.ArgError(1, "searches must be tables")
+			return 0
+		}
+		item := search.MSearchItem{
+			Index: lua.LVAsString(s.RawGetString("index")),
+			Query: esBody(l, s.RawGetString("body")),
+		}
+		if item.Index == "" {
+			l.ArgError(1, "searches must have an index")
+			return 0
+		}
+		if item.Query == nil {
+			item.Query = map[string]interface{}{}
+		}
+		items = append(items, item)
+	}
+
+	results, errs, err := search.MSearch(runContext(l), items)
+	if err != nil {
+		return esError(l, err)
+	}
+
+	ret := l.NewTable()
+	for i := range results {
+		if errs[i] != nil {
+			e := l.NewTable()
+			e.RawSetString("error", lua.LString(errs[i].Error()))
+			ret.RawSetInt(i+1, e)
+			continue
+		}
+		ret.RawSetInt(i+1, pushArbitraryValue(l, results[i]))
+	}
+	l.Push(ret)
+	return 1
+}
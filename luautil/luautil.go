@@ -3,14 +3,18 @@ package luautil
 
 import (
 	"bytes"
+	gocontext "context"
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cjoudrey/gluahttp"
 	_ "github.com/lib/pq"
@@ -25,67 +29,83 @@ import (
 )
 
 // LuaRunner performs some arbitrary lua code. The code can either be sourced from a
-// file or from a raw string (Inline).
+// file or from a raw string (Inline). Sandbox is the name of the sandbox
+// profile the code is run in, empty means the lua-sandbox one
 type LuaRunner struct {
-	File   string `yaml:"lua_file"`
-	Inline string `yaml:"lua_inline"`
+	File    string `yaml:"lua_file"`
+	Inline  string `yaml:"lua_inline"`
+	Sandbox string `yaml:"lua_sandbox"`
 }
 
 // Do performs the actual lua code, returning whatever the lua code returned, or
-// false if there was an error
-func (l *LuaRunner) Do(c context.Context) (interface{}, bool) {
-	if l.File != "" {
-		return RunFile(c, l.File)
-	} else if l.Inline != "" {
-		return RunInline(c, l.Inline)
-	}
-	return nil, false
+// an error if it couldn't be loaded or failed
+func (l *LuaRunner) Do(c context.Context) (interface{}, error) {
+	if l.File == "" && l.Inline == "" {
+		return nil, errors.New("no lua code given")
+	}
+	return run(cmd{
+		ctx:      c,
+		filename: l.File,
+		inline:   l.Inline,
+		sandbox:  l.Sandbox,
+	})
 }
 
 type cmd struct {
 	ctx      context.Context
 	filename string
 	inline   string
-	retCh    chan interface{}
+	sandbox  string
+	retCh    chan result
+}
+
+type result struct {
+	val interface{}
+	err error
 }
 
 var cmdCh = make(chan cmd)
 
-// RunInline takes the given lua code, and runs it with the given ctx variable
-// set as the lua global variable "ctx". The lua code is expected to return a
-// boolean value, which is passed back as the first boolean return. The second
-// boolean return will be false if there was an error and the code wasn't run
-func RunInline(ctx context.Context, code string) (interface{}, bool) {
-	c := cmd{
-		ctx:    ctx,
-		inline: code,
-		retCh:  make(chan interface{}),
-	}
+func run(c cmd) (interface{}, error) {
+	c.retCh = make(chan result)
 	cmdCh <- c
-	ret, ok := <-c.retCh
-	return ret, ok
+	res := <-c.retCh
+	return res.val, res.err
+}
+
+// RunInline takes the given lua code, and runs it with the given ctx variable
+// set as the lua global variable "ctx". Whatever the lua code returns is passed
+// back, or an error if the code couldn't be loaded or failed
+func RunInline(ctx context.Context, code string) (interface{}, error) {
+	return run(cmd{ctx: ctx, inline: code})
 }
 
 // RunFile is similar to RunInline, except it takes in a filename which has the
-// lua code to run. Note that the file's contents are cached, so the file is
-// only opened and read the first time it's used.
-func RunFile(ctx context.Context, filename string) (interface{}, bool) {
-	c := cmd{
-		ctx:      ctx,
-		filename: filename,
-		retCh:    make(chan interface{}),
-	}
-	cmdCh <- c
-	ret, ok := <-c.retCh
-	return ret, ok
+// lua code to run. Note that the file is compiled once per vm, and only
+// recompiled when its contents change.
+func RunFile(ctx context.Context, filename string) (interface{}, error) {
+	return run(cmd{ctx: ctx, filename: filename})
 }
 
 type runner struct {
 	id int // solely used to tell lua vms apart in logs
 	l  *lua.LState
 
-	// Set of files and inline functions hashes already in the global namespace
+	// Set of inline functions hashes already in the global namespace
 	m map[string]bool
+
+	// Files already in the global namespace, by name
+	files map[string]luaFile
+
+	// Modules loaded from lua-path, by name
+	modules map[string]luaModule
+
+	// Name of the alert being run, which the store module's keys are
+	// namespaced by
+	alert string
+
+	// Global environments of the sandbox profiles, by name
+	envs map[string]*lua.LTable
 }
 
 func init() {
@@ -95,22 +115,49 @@ func init() {
 }
 
 func newRunner(i int) {
-	l := lua.NewState()
+	opts := lua.Options{
+		CallStackSize:   config.Opts.LuaCallStackSize,
+		RegistryMaxSize: config.Opts.LuaRegistryMaxSize,
+	}
+	if opts.RegistryMaxSize > 0 && opts.RegistryMaxSize < lua.RegistrySize {
+		opts.RegistrySize = opts.RegistryMaxSize
+	}
+	l := lua.NewState(opts)
 
 	// Preload modules
 	gluasocket.Preload(l)
 	gluasql.Preload(l)
-	l.PreloadModule("http", gluahttp.NewHttpModule(&http.Client{}).Loader)
+	l.PreloadModule("http", gluahttp.NewHttpModule(&http.Client{Transport: runTransport{l}}).Loader)
 	gluajson.Preload(l)
-
-	r := runner{
-		id: i,
-		l:  l,
-		m:  map[string]bool{},
+	l.PreloadModule("telegram", telegramLoader)
+	l.PreloadModule("es", esLoader)
+
+	r := &runner{
+		id:      i,
+		l:       l,
+		m:       map[string]bool{},
+		files:   map[string]luaFile{},
+		modules: map[string]luaModule{},
+		envs:    map[string]*lua.LTable{},
 	}
+	r.initPath()
+	l.PreloadModule("store", r.storeLoader)
 	go r.spin()
 }
 
+// runTransport performs the requests of the http module with the context of
+// the vm's current run, so they're aborted once it times out
+type runTransport struct {
+	l *lua.LState
+}
+
+func (t runTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if ctx := t.l.Context(); ctx != nil {
+		req = req.WithContext(ctx)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
 func shortInline(code string) string {
 	if len(code) > 20 {
 		return code[:20] + " ..."
@@ -158,53 +205,138 @@ func (r *runner) spin() {
 		if err != nil {
 			kv["err"] = err
 			log.LogError.WithFields(kv).Errorln("error loading lua")
-			close(c.retCh)
+			c.retCh <- result{err: err}
 			continue
 		}
 
 		kv["fnName"] = fnName
 		log.LogAccess.WithFields(kv).Debugln("executing lua")
 
-		val := pushArbitraryValue(r.l, c.ctx) // push ctx onto the stack
-		r.l.SetGlobal("ctx", val)             // set global variable "ctx" to ctx, pops it from stack
-		// push function onto stack
-		// call function, pops function from stack, pushes return
-		if err = r.l.CallByParam(lua.P{
-			Fn:      r.l.GetGlobal(fnName),
-			NRet:    1,
-			Protect: false,
-		}); err != nil {
-			log.LogError.WithFields(kv).Fatalln("error executing lua")
+		val, err := r.call(c, fnName)
+		if err != nil {
+			kv["err"] = err
+			log.LogError.WithFields(kv).Errorln("error executing lua")
 		}
-		c.retCh <- PullArbitraryValue(r.l, true) // send back the function return, also popping it
-		// stack is now clean
+		c.retCh <- result{val: val, err: err}
+		delete(kv, "err")
 	}
 }
 
-func (r *runner) loadFile(name string) (string, error) {
-	key := quickSha(name)
-	if r.m[key] {
-		return key, nil
+// call calls the loaded function of the given name in the cmd's sandbox, with
+// the cmd's ctx set as the global variable "ctx"
+func (r *runner) call(c cmd, fnName string) (interface{}, error) {
+	sb, ok := sandboxByName(c.sandbox)
+	if !ok {
+		return nil, fmt.Errorf("unknown lua sandbox: %q", c.sandbox)
 	}
 
-	log.LogAccess.WithFields(logrus.Fields{
+	r.refreshModules()
+
+	r.alert = c.ctx.Name
+	fn := r.l.GetGlobal(fnName).(*lua.LFunction)
+	if len(sb.Deny) > 0 {
+		fn.Env = r.sandboxEnv(sb)
+	} else {
+		fn.Env = r.l.G.Global
+	}
+	fn.Env.RawSetString("ctx", pushArbitraryValue(r.l, c.ctx))
+
+	timeout := config.Opts.LuaTimeout
+	if sb.Timeout > 0 {
+		timeout = sb.Timeout
+	}
+	if timeout > 0 {
+		ctx, cancel := gocontext.WithTimeout(gocontext.Background(), timeout)
+		defer cancel()
+		r.l.SetContext(ctx)
+		defer r.l.RemoveContext()
+	}
+
+	// call function, pops function from stack, pushes return
+	err := r.l.CallByParam(lua.P{
+		Fn:      fn,
+		NRet:    1,
+		Protect: true,
+	})
+	// a call into go aborted by the timeout may have been the last thing the
+	// code did, in which case it returned normally
+	if ctx := r.l.Context(); ctx != nil && ctx.Err() == gocontext.DeadlineExceeded {
+		r.l.SetTop(0)
+		return nil, fmt.Errorf("lua timed out after %s", timeout)
+	} else if err != nil {
+		r.l.SetTop(0)
+		return nil, err
+	}
+	// send back the function return, also popping it. The stack is now clean
+	return PullArbitraryValue(r.l, true), nil
+}
+
+// luaFile describes the version of a file which is loaded into a vm
+type luaFile struct {
+	modTime time.Time
+	size    int64
+	hash    string // sha of the file's contents
+}
+
+// loadFile loads the given file into the global namespace, returning the name
+// of its global. The file is checked for changes every time, and reloaded if
+// its contents changed. If the changed file can't be loaded the previously
+// loaded version is kept
+func (r *runner) loadFile(name string) (string, error) {
+	key := quickSha(name)
+	kv := logrus.Fields{
 		"runnerID": r.id,
 		"filename": name,
 		"fnName":   key,
-	}).Debugln("loading lua file")
-	f, err := os.Open(name)
+	}
+
+	prev, loaded := r.files[name]
+	fi, err := os.Stat(name)
 	if err != nil {
-		return "", err
+		return r.keepFile(key, loaded, kv, err)
+	}
+	if loaded && fi.ModTime().Equal(prev.modTime) && fi.Size() == prev.size {
+		return key, nil
 	}
-	defer f.Close()
 
-	var fn *lua.LFunction
-	if fn, err = r.l.Load(f, name); err != nil {
-		return "", err
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return r.keepFile(key, loaded, kv, err)
+	}
+	file := luaFile{modTime: fi.ModTime(), size: fi.Size(), hash: quickSha(string(b))}
+	if loaded && file.hash == prev.hash {
+		r.files[name] = file
+		return key, nil
+	}
+
+	if loaded {
+		log.LogAccess.WithFields(kv).Infoln("reloading changed lua file")
+	} else {
+		log.LogAccess.WithFields(kv).Debugln("loading lua file")
+	}
+	fn, err := r.l.Load(bytes.NewReader(b), name)
+	if err != nil {
+		if loaded {
+			// don't retry until the file changes again
+			prev.modTime, prev.size = file.modTime, file.size
+			r.files[name] = prev
+		}
+		return r.keepFile(key, loaded, kv, err)
 	}
 	r.l.SetGlobal(key, fn)
 
-	r.m[key] = true
+	r.files[name] = file
+	return key, nil
+}
+
+// keepFile returns the given load error, unless a previous version of the
+// file is loaded, which is then kept
+func (r *runner) keepFile(key string, loaded bool, kv logrus.Fields, err error) (string, error) {
+	if !loaded {
+		return "", err
+	}
+	kv["err"] = err
+	log.LogError.WithFields(kv).Errorln("error reloading lua file, keeping the previous version")
 	return key, nil
 }
 
@@ -328,6 +460,9 @@ func pushArbitraryValue(l *lua.LState, i interface{}) lua.LValue {
 		v := reflect.ValueOf(i)
 		switch v.Kind() {
 		case reflect.Ptr:
+			if v.IsNil() {
+				return lua.LNil
+			}
 			return pushArbitraryValue(l, v.Elem().Interface())
 
 		case reflect.Struct:
@@ -4,14 +4,21 @@ import (
 	"bytes"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/tengattack/esalert/config"
 	"github.com/tengattack/esalert/context"
 	"github.com/tengattack/esalert/luautil"
+	"github.com/tengattack/esalert/store"
 	lua "github.com/yuin/gopher-lua"
 )
 
@@ -85,15 +92,19 @@ func TestTableFromStruct(t *testing.T) {
 		Bar `luautil:",inline"`
 		E   string
 		F   int `luautil:"-"`
+		G   *Foo
+		H   *Foo
 	}
 
-	i := Baz{Bar{Foo{1, "wat"}, true}, "wut", 5}
+	i := Baz{Bar{Foo{1, "wat"}, true}, "wut", 5, &Foo{2, "wot"}, nil}
 	testPushFrom(t, luautil.PushTableFromStruct, i, `
 		if ctx.C.A ~= 1 then return false end
 		if ctx.C.B ~= "wat" then return false end
 		if ctx.d ~= true then return false end
 		if ctx.E ~= "wut" then return false end
 		if ctx.F ~= nil then return false end
+		if ctx.G.A ~= 2 then return false end
+		if ctx.H ~= nil then return false end
 		return true
 	`)
 }
@@ -140,13 +151,13 @@ func TestRun(t *testing.T) {
 	}
 	code := `return ctx.Name == "foo"`
 
-	ret, ok := luautil.RunInline(ctx, code)
-	assert.True(t, ok)
+	ret, err := luautil.RunInline(ctx, code)
+	assert.NoError(t, err)
 	assert.Equal(t, true, ret)
 
 	ctx.Name = "bar"
-	ret, ok = luautil.RunInline(ctx, code)
-	assert.True(t, ok)
+	ret, err = luautil.RunInline(ctx, code)
+	assert.NoError(t, err)
 	assert.Equal(t, false, ret)
 
 	f, err := ioutil.TempFile("", "")
@@ -160,12 +171,246 @@ func TestRun(t *testing.T) {
 	ctx = context.Context{
 		Name: "foo",
 	}
-	ret, ok = luautil.RunFile(ctx, filename)
-	assert.True(t, ok)
+	ret, err = luautil.RunFile(ctx, filename)
+	assert.NoError(t, err)
 	assert.Equal(t, true, ret)
 
 	ctx.Name = "bar"
-	ret, ok = luautil.RunFile(ctx, filename)
-	assert.True(t, ok)
+	ret, err = luautil.RunFile(ctx, filename)
+	assert.NoError(t, err)
 	assert.Equal(t, false, ret)
 }
+
+func TestStoreModule(t *testing.T) {
+	defer store.Reset()
+
+	code := `
+		local store = require("store")
+		local n = store.incr("runs")
+		store.set("last", {n = n, name = ctx.Name})
+		if store.get("gone") ~= nil then return false end
+		store.set("gone", "soon", 60)
+		store.delete("gone")
+		return n`
+
+	ret, err := luautil.RunInline(context.Context{Name: "foo"}, code)
+	require.NoError(t, err)
+	assert.Equal(t, 1, ret)
+	ret, err = luautil.RunInline(context.Context{Name: "foo"}, code)
+	require.NoError(t, err)
+	assert.Equal(t, 2, ret)
+
+	// keys are namespaced per alert
+	ret, err = luautil.RunInline(context.Context{Name: "bar"}, code)
+	require.NoError(t, err)
+	assert.Equal(t, 1, ret)
+
+	v, ok := store.Get("foo", "last")
+	require.True(t, ok)
+	assert.Equal(t, map[string]interface{}{"n": 2, "name": "foo"}, v)
+	_, ok = store.Get("foo", "gone")
+	assert.False(t, ok)
+}
+
+func TestESModule(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		switch r.URL.Path {
+		case "/logs/_search":
+			assert.JSONEq(t, `{"size":5}`, string(body))
+			io.WriteString(w, `{"took":1,"hits":{"total":2,"hits":[{"_id":"a","_source":{"host":"web1"}}]}}`)
+		case "/logs/_count":
+			assert.JSONEq(t, `{"query":{"term":{"level":"error"}}}`, string(body))
+			io.WriteString(w, `{"count":42}`)
+		case "/_msearch":
+			assert.Equal(t, "{\"index\":\"a\"}\n{}\n{\"index\":\"b\"}\n{}\n", string(body))
+			io.WriteString(w, `{"responses":[{"hits":{"total":3}},{"error":{"type":"index_not_found_exception","reason":"no such index"}}]}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	addr := config.Opts.ElasticSearchAddr
+	defer func() { config.Opts.ElasticSearchAddr = addr }()
+	config.Opts.ElasticSearchAddr = strings.TrimPrefix(srv.URL, "http://")
+
+	ret, err := luautil.RunInline(context.Context{}, `
+		local es = require("es")
+		local res = es.search("logs", {size = 5})
+		local n = es.count("logs", '{"query":{"term":{"level":"error"}}}')
+		local m = es.msearch({{index = "a"}, {index = "b", body = {}}})
+		local _, err = es.count("missing")
+		return {res.HitCount, res.Hits[1].Source.host, n, m[1].HitCount, m[2].error, err}`)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{
+		2, "web1", 42, 3,
+		"index_not_found_exception: no such index",
+		"HTTP status code: 404",
+	}, ret)
+}
+
+func TestSandbox(t *testing.T) {
+	sandboxes := config.Opts.LuaSandboxes
+	defer func() { config.Opts.LuaSandboxes = sandboxes }()
+	config.Opts.LuaSandboxes = []config.LuaSandbox{
+		{Name: "quick", Timeout: 50 * time.Millisecond},
+	}
+
+	assert.NoError(t, luautil.ValidateSandbox(""))
+	assert.NoError(t, luautil.ValidateSandbox(luautil.StrictSandbox))
+	assert.NoError(t, luautil.ValidateSandbox("quick"))
+	assert.Error(t, luautil.ValidateSandbox("nope"))
+
+	strict := luautil.LuaRunner{Sandbox: luautil.StrictSandbox}
+	strict.Inline = `
+		return {
+			os = os == nil,
+			io = io == nil,
+			getfenv = getfenv == nil,
+			loaded = loadstring("return os")() == nil,
+			g = _G.os == nil,
+			telegram = require("telegram") ~= nil,
+			name = ctx.Name,
+		}`
+	ret, err := strict.Do(context.Context{Name: "foo"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"os": true, "io": true, "getfenv": true, "loaded": true, "g": true,
+		"telegram": true, "name": "foo",
+	}, ret)
+
+	for _, mod := range []string{"socket.http", "os", "io", "debug", "_G", "package"} {
+		strict.Inline = `return require("` + mod + `")`
+		_, err = strict.Do(context.Context{})
+		assert.Error(t, err, mod)
+	}
+
+	// the unrestricted globals can't be reached through require either
+	strict.Inline = `
+		local ok, g = pcall(require, "_G")
+		if ok and g.os ~= nil then return true end
+		ok, g = pcall(require, "package")
+		if ok and g.loaded.os ~= nil then return true end
+		return false`
+	ret, err = strict.Do(context.Context{})
+	require.NoError(t, err)
+	assert.Equal(t, false, ret)
+
+	// the unrestricted environment isn't affected
+	ret, err = luautil.RunInline(context.Context{}, `return os ~= nil and io ~= nil`)
+	require.NoError(t, err)
+	assert.Equal(t, true, ret)
+
+	quick := luautil.LuaRunner{Sandbox: "quick", Inline: `while true do end`}
+	_, err = quick.Do(context.Context{})
+	assert.EqualError(t, err, "lua timed out after 50ms")
+
+	// calls into elasticsearch are aborted along with the run
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer srv.Close()
+	defer close(block)
+	addr := config.Opts.ElasticSearchAddr
+	defer func() { config.Opts.ElasticSearchAddr = addr }()
+	config.Opts.ElasticSearchAddr = strings.TrimPrefix(srv.URL, "http://")
+
+	quick.Inline = `return require("es").count("logs")`
+	start := time.Now()
+	_, err = quick.Do(context.Context{})
+	assert.EqualError(t, err, "lua timed out after 50ms")
+	assert.True(t, time.Since(start) < time.Second)
+
+	_, err = luautil.RunInline(context.Context{}, `local function f() return 1 + f() end return f()`)
+	assert.Error(t, err)
+
+	_, err = luautil.RunInline(context.Context{}, `error("boom")`)
+	assert.Error(t, err)
+
+	// the vm is still usable after the failures
+	ret, err = luautil.RunInline(context.Context{}, `return 1`)
+	require.NoError(t, err)
+	assert.Equal(t, 1, ret)
+}
+
+func TestRunFileReload(t *testing.T) {
+	f, err := ioutil.TempFile("", "")
+	require.Nil(t, err)
+	filename := f.Name()
+	defer os.Remove(filename)
+	f.Close()
+
+	write := func(code string, mod time.Time) {
+		require.Nil(t, ioutil.WriteFile(filename, []byte(code), 0644))
+		require.Nil(t, os.Chtimes(filename, mod, mod))
+	}
+	now := time.Now()
+
+	write(`return 1`, now)
+	ret, err := luautil.RunFile(context.Context{}, filename)
+	require.NoError(t, err)
+	assert.Equal(t, 1, ret)
+
+	write(`return 2`, now.Add(time.Second))
+	ret, err = luautil.RunFile(context.Context{}, filename)
+	require.NoError(t, err)
+	assert.Equal(t, 2, ret)
+
+	// a compile error keeps the previous version
+	write(`return (`, now.Add(2*time.Second))
+	ret, err = luautil.RunFile(context.Context{}, filename)
+	require.NoError(t, err)
+	assert.Equal(t, 2, ret)
+
+	write(`return 3`, now.Add(3*time.Second))
+	ret, err = luautil.RunFile(context.Context{}, filename)
+	require.NoError(t, err)
+	assert.Equal(t, 3, ret)
+}
+
+func TestLuaPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	require.Nil(t, os.MkdirAll(filepath.Join(dir, "lib", "limits"), 0755))
+
+	luaPath := config.Opts.LuaPath
+	defer func() { config.Opts.LuaPath = luaPath }()
+	config.Opts.LuaPath = []string{dir}
+
+	write := func(name, code string, mod time.Time) {
+		filename := filepath.Join(dir, name)
+		require.Nil(t, ioutil.WriteFile(filename, []byte(code), 0644))
+		require.Nil(t, os.Chtimes(filename, mod, mod))
+	}
+	now := time.Now()
+	write("lib/thresholds.lua", `return {high = 10}`, now)
+	write("lib/limits/init.lua", `local t = require("lib.thresholds") return {max = t.high * 2}`, now)
+	require.NoError(t, luautil.CheckPath())
+
+	code := `return require("lib.thresholds").high + require("lib.limits").max`
+	ret, err := luautil.RunInline(context.Context{}, code)
+	require.NoError(t, err)
+	assert.Equal(t, 30, ret)
+
+	// modules depending on the changed one are reloaded too
+	write("lib/thresholds.lua", `return {high = 100}`, now.Add(time.Second))
+	ret, err = luautil.RunInline(context.Context{}, code)
+	require.NoError(t, err)
+	assert.Equal(t, 300, ret)
+
+	// a compile error keeps the previous version, but fails the startup check
+	write("lib/thresholds.lua", `return {`, now.Add(2*time.Second))
+	ret, err = luautil.RunInline(context.Context{}, code)
+	require.NoError(t, err)
+	assert.Equal(t, 300, ret)
+	assert.Error(t, luautil.CheckPath())
+
+	_, err = luautil.RunInline(context.Context{}, `return require("lib.missing")`)
+	assert.Error(t, err)
+
+	config.Opts.LuaPath = []string{filepath.Join(dir, "nope")}
+	assert.Error(t, luautil.CheckPath())
+}
@@ -0,0 +1,191 @@
+package luautil
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tengattack/esalert/config"
+	"github.com/tengattack/tgo/log"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// luaModule describes the version of a module which is loaded from lua-path
+type luaModule struct {
+	file string
+	luaFile
+	fn *lua.LFunction // the compiled file, kept in case a newer version fails
+}
+
+// pathTemplates returns the package.path templates of the lua-path
+// directories
+func pathTemplates() []string {
+	var templates []string
+	for _, dir := range config.Opts.LuaPath {
+		templates = append(templates, filepath.Join(dir, "?.lua"), filepath.Join(dir, "?", "init.lua"))
+	}
+	return templates
+}
+
+// CheckPath makes sure all lua-path entries are directories, and that all the
+// lua files in them compile
+func CheckPath() error {
+	l := lua.NewState(lua.Options{SkipOpenLibs: true})
+	defer l.Close()
+
+	for _, dir := range config.Opts.LuaPath {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return err
+		} else if !fi.IsDir() {
+			return fmt.Errorf("lua path %s is not a directory", dir)
+		}
+
+		err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+			if err != nil || fi.IsDir() || filepath.Ext(path) != ".lua" {
+				return err
+			}
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			_, err = l.Load(bytes.NewReader(b), path)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// initPath adds the lua-path directories to package.path, and has modules
+// found in them loaded by pathLoader, which keeps track of their files
+func (r *runner) initPath() {
+	pkg := r.l.GetGlobal("package").(*lua.LTable)
+	if templates := pathTemplates(); len(templates) > 0 {
+		path := strings.Join(templates, ";") + ";" + lua.LVAsString(pkg.RawGetString("path"))
+		pkg.RawSetString("path", lua.LString(path))
+	}
+
+	// right after the preload loader, so bundled modules can't be shadowed
+	loaders := pkg.RawGetString("loaders").(*lua.LTable)
+	loaders.Insert(2, r.l.NewFunction(r.pathLoader))
+}
+
+// findModule returns the file of the given module in the lua-path
+// directories, or an empty string if there's none
+func findModule(name string) string {
+	name = strings.Replace(name, ".", string(os.PathSeparator), -1)
+	for _, tpl := range pathTemplates() {
+		file := strings.Replace(tpl, "?", name, -1)
+		if fi, err := os.Stat(file); err == nil && !fi.IsDir() {
+			return file
+		}
+	}
+	return ""
+}
+
+// pathLoader is a package.loaders function loading modules from the lua-path
+// directories. If a module's file can't be loaded, but a previous version of
+// it was, that version is used instead
+func (r *runner) pathLoader(l *lua.LState) int {
+	name := l.CheckString(1)
+	prev, loaded := r.modules[name]
+	kv := logrus.Fields{
+		"runnerID": r.id,
+		"module":   name,
+	}
+
+	fail := func(err error) int {
+		if !loaded {
+			l.RaiseError("%s", err)
+			return 0
+		}
+		kv["err"] = err
+		log.LogError.WithFields(kv).Errorln("error reloading lua module, keeping the previous version")
+		l.Push(prev.fn)
+		return 1
+	}
+
+	file := findModule(name)
+	if file == "" {
+		if loaded {
+			return fail(fmt.Errorf("no file for module %s in lua path", name))
+		} else if len(config.Opts.LuaPath) == 0 {
+			// leave it to the other loaders without a message
+			l.Push(lua.LNil)
+			return 1
+		}
+		l.Push(lua.LString(fmt.Sprintf("no file for module %s in lua path", name)))
+		return 1
+	}
+	kv["filename"] = file
+
+	fi, err := os.Stat(file)
+	if err != nil {
+		return fail(err)
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fail(err)
+	}
+	mod := luaModule{
+		file:    file,
+		luaFile: luaFile{modTime: fi.ModTime(), size: fi.Size(), hash: quickSha(string(b))},
+	}
+
+	log.LogAccess.WithFields(kv).Debugln("loading lua module")
+	if mod.fn, err = l.Load(bytes.NewReader(b), file); err != nil {
+		if loaded {
+			// don't reload until the file changes again
+			prev.file, prev.modTime, prev.size = file, mod.modTime, mod.size
+			r.modules[name] = prev
+		}
+		return fail(err)
+	}
+
+	r.modules[name] = mod
+	l.Push(mod.fn)
+	return 1
+}
+
+// refreshModules unloads all modules loaded from the lua-path directories if
+// any of their files changed, so they're loaded again when next required.
+// All of them are unloaded as modules may hold on to each other
+func (r *runner) refreshModules() {
+	var changed bool
+	for name, mod := range r.modules {
+		// files which can't be read keep the previous version loaded
+		fi, err := os.Stat(mod.file)
+		if err != nil || fi.ModTime().Equal(mod.modTime) && fi.Size() == mod.size {
+			continue
+		}
+
+		b, err := ioutil.ReadFile(mod.file)
+		if err != nil {
+			continue
+		}
+		if quickSha(string(b)) != mod.hash {
+			changed = true
+			break
+		}
+		mod.modTime, mod.size = fi.ModTime(), fi.Size()
+		r.modules[name] = mod
+	}
+	if !changed {
+		return
+	}
+
+	log.LogAccess.WithFields(logrus.Fields{
+		"runnerID": r.id,
+	}).Infoln("reloading changed lua modules")
+	loaded := r.l.GetField(r.l.GetGlobal("package"), "loaded").(*lua.LTable)
+	for name := range r.modules {
+		loaded.RawSetString(name, lua.LNil)
+	}
+}
@@ -0,0 +1,146 @@
+package luautil
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tengattack/esalert/config"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// StrictSandbox is the name of the built-in sandbox profile, which denies
+// access to the filesystem, processes, the network and the vm internals. It
+// may be overridden by a profile of the same name in lua-sandboxes
+const StrictSandbox = "strict"
+
+var strictDeny = []string{"os", "io", "debug", "socket", "sql", "http"}
+
+// globals which would let code escape any sandbox, by reaching the
+// unrestricted global environment or the loaded modules
+var sandboxEscapes = []string{"getfenv", "setfenv", "module", "package", "dofile"}
+
+// globals which compile code, the functions they return are moved into the
+// sandbox's environment
+var sandboxLoaders = []string{"load", "loadstring", "loadfile"}
+
+// sandboxByName returns the sandbox profile of the given name, an empty name
+// is the default profile
+func sandboxByName(name string) (config.LuaSandbox, bool) {
+	if name == "" {
+		name = config.Opts.LuaSandbox
+		if name == "" {
+			return config.LuaSandbox{}, true
+		}
+	}
+	for _, sb := range config.Opts.LuaSandboxes {
+		if sb.Name == name {
+			return sb, true
+		}
+	}
+	if name == StrictSandbox {
+		return config.LuaSandbox{Name: StrictSandbox, Deny: strictDeny}, true
+	}
+	return config.LuaSandbox{}, false
+}
+
+// ValidateSandbox returns an error if there's no sandbox profile of the given
+// name. An empty name is valid, and means the default profile
+func ValidateSandbox(name string) error {
+	if _, ok := sandboxByName(name); !ok {
+		return fmt.Errorf("unknown lua sandbox: %q", name)
+	}
+	return nil
+}
+
+func denied(sb config.LuaSandbox, name string) bool {
+	for _, d := range sb.Deny {
+		if name == d || strings.HasPrefix(name, d+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// sandboxEnv returns the global environment code run in the given sandbox
+// sees. It's a copy of the vm's globals without the denied ones, which is
+// created once per vm, so globals set by the code persist across runs like
+// they do in the unrestricted environment
+func (r *runner) sandboxEnv(sb config.LuaSandbox) *lua.LTable {
+	if env, ok := r.envs[sb.Name]; ok {
+		return env
+	}
+
+	skip := map[string]bool{}
+	for _, name := range sandboxEscapes {
+		skip[name] = true
+	}
+	if denied(sb, "io") {
+		skip["loadfile"] = true
+	}
+
+	env := r.l.NewTable()
+	r.l.G.Global.ForEach(func(k, v lua.LValue) {
+		if name, ok := k.(lua.LString); ok && (skip[string(name)] || denied(sb, string(name))) {
+			return
+		}
+		env.RawSet(k, v)
+	})
+	env.RawSetString("_G", env)
+
+	for _, name := range sandboxLoaders {
+		if loader, ok := env.RawGetString(name).(*lua.LFunction); ok {
+			env.RawSetString(name, sandboxLoader(r.l, loader, env))
+		}
+	}
+
+	// modules which are, or give access to, the unrestricted globals or the
+	// denied ones can't be required
+	pkg := r.l.GetGlobal("package")
+	forbidden := map[lua.LValue]bool{
+		r.l.G.Global:                 true,
+		pkg:                          true,
+		r.l.GetField(pkg, "loaded"):  true,
+		r.l.GetField(pkg, "loaders"): true,
+		r.l.GetField(pkg, "preload"): true,
+		r.l.Get(lua.RegistryIndex):   true,
+	}
+	for _, name := range append(append([]string{}, sandboxEscapes...), sb.Deny...) {
+		if v := r.l.GetGlobal(name); v != lua.LNil {
+			forbidden[v] = true
+		}
+	}
+
+	require := r.l.GetGlobal("require")
+	env.RawSetString("require", r.l.NewFunction(func(l *lua.LState) int {
+		name := l.CheckString(1)
+		if name == "_G" || skip[name] || denied(sb, name) {
+			l.RaiseError("module %s is denied by lua sandbox %s", name, sb.Name)
+			return 0
+		}
+		l.Push(require)
+		l.Push(lua.LString(name))
+		l.Call(1, 1)
+		if forbidden[l.Get(-1)] {
+			l.RaiseError("module %s is denied by lua sandbox %s", name, sb.Name)
+			return 0
+		}
+		return 1
+	}))
+
+	r.envs[sb.Name] = env
+	return env
+}
+
+// sandboxLoader wraps a function compiling code, so the functions it returns
+// run in the given environment instead of the unrestricted one
+func sandboxLoader(l *lua.LState, loader *lua.LFunction, env *lua.LTable) *lua.LFunction {
+	return l.NewFunction(func(l *lua.LState) int {
+		top := l.GetTop()
+		l.Insert(loader, 1)
+		l.Call(top, lua.MultRet)
+		if fn, ok := l.Get(1).(*lua.LFunction); ok {
+			fn.Env = env
+		}
+		return l.GetTop()
+	})
+}
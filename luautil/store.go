@@ -0,0 +1,66 @@
+package luautil
+
+import (
+	"time"
+
+	"github.com/tengattack/esalert/store"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// storeLoader loads the "store" module, a key/value store shared by all lua
+// vms. Keys are namespaced by the name of the alert being run, ttls are given
+// in seconds
+func (r *runner) storeLoader(l *lua.LState) int {
+	l.Push(l.SetFuncs(l.NewTable(), map[string]lua.LGFunction{
+		"get":    r.storeGet,
+		"set":    r.storeSet,
+		"incr":   r.storeIncr,
+		"delete": r.storeDelete,
+	}))
+	return 1
+}
+
+func ttlArg(l *lua.LState, n int) time.Duration {
+	return time.Duration(float64(l.OptNumber(n, 0)) * float64(time.Second))
+}
+
+// store.get(key) returns the key's value, or nil if it isn't set
+func (r *runner) storeGet(l *lua.LState) int {
+	v, ok := store.Get(r.alert, l.CheckString(1))
+	if !ok {
+		l.Push(lua.LNil)
+		return 1
+	}
+	l.Push(pushArbitraryValue(l, v))
+	return 1
+}
+
+// store.set(key, value[, ttl]) sets the key, setting it to nil deletes it
+func (r *runner) storeSet(l *lua.LState) int {
+	key := l.CheckString(1)
+	v := l.CheckAny(2)
+	if v == lua.LNil {
+		store.Delete(r.alert, key)
+		return 0
+	}
+	store.Set(r.alert, key, pullArbitraryValueInner(l, v), ttlArg(l, 3))
+	return 0
+}
+
+// store.incr(key[, by[, ttl]]) increments the key by 1, or by, and returns
+// its new value. The ttl only applies if the key isn't set yet
+func (r *runner) storeIncr(l *lua.LState) int {
+	n, err := store.Incr(r.alert, l.CheckString(1), float64(l.OptNumber(2, 1)), ttlArg(l, 3))
+	if err != nil {
+		l.RaiseError("%s", err)
+		return 0
+	}
+	l.Push(lua.LNumber(n))
+	return 1
+}
+
+// store.delete(key) unsets the key
+func (r *runner) storeDelete(l *lua.LState) int {
+	store.Delete(r.alert, l.CheckString(1))
+	return 0
+}
@@ -0,0 +1,27 @@
+package luautil
+
+import (
+	"github.com/tengattack/esalert/action"
+	lua "github.com/yuin/gopher-lua"
+)
+
+var telegramFuncs = map[string]lua.LGFunction{
+	"escape_markdown_v2": telegramEscape(action.EscapeMarkdownV2),
+	"escape_markdown":    telegramEscape(action.EscapeMarkdown),
+	"escape_html":        telegramEscape(action.EscapeHTML),
+}
+
+// telegramLoader loads the "telegram" module, which has helpers for escaping
+// values (e.g. pulled from ctx.Hits) before putting them in the text of a
+// telegram action
+func telegramLoader(l *lua.LState) int {
+	l.Push(l.SetFuncs(l.NewTable(), telegramFuncs))
+	return 1
+}
+
+func telegramEscape(fn func(string) string) lua.LGFunction {
+	return func(l *lua.LState) int {
+		l.Push(lua.LString(fn(lua.LVAsString(l.CheckAny(1)))))
+		return 1
+	}
+}
@@ -0,0 +1,570 @@
+// Package queue implements a durable queue of actions waiting to be performed,
+// so that notifications aren't lost while their receiver is down or esalert
+// is restarted.
+//
+// Every change to the queue is appended to a write-ahead file before it takes
+// effect, and the file is replayed when the queue is opened. Items which
+// permanently fail to be delivered are appended to a dead-letter file.
+package queue
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tengattack/esalert/action"
+	"github.com/tengattack/esalert/context"
+	"github.com/tengattack/tgo/log"
+)
+
+// Names of the files kept in the queue's directory
+const (
+	WALFile        = "queue.wal"
+	DeadLetterFile = "deadletter.jsonl"
+)
+
+// compactAfter is the number of records appended to the write-ahead file
+// after which it's rewritten with only the pending items
+const compactAfter = 1000
+
+// Item is a single action waiting to be performed. MaxConcurrency is the
+// MaxConcurrency of the alert which pushed it
+type Item struct {
+	ID             uint64                 `json:"id"`
+	Action         map[string]interface{} `json:"action"`
+	Context        context.Context        `json:"context"`
+	MaxConcurrency int                    `json:"max_concurrency,omitempty"`
+	Enqueued       time.Time              `json:"enqueued"`
+	Attempts       int                    `json:"attempts"`
+	LastError      string                 `json:"last_error,omitempty"`
+}
+
+// groupKey identifies the ordering group of an alert's actions
+type groupKey struct {
+	name, group string
+}
+
+// groupKey returns the item's ordering group, if it belongs to one
+func (it *Item) groupKey() (groupKey, bool) {
+	g, _ := it.Action["group"].(string)
+	return groupKey{name: it.Context.Name, group: g}, g != ""
+}
+
+// record is a single line of the write-ahead file
+type record struct {
+	Op       string `json:"op"`
+	Item     *Item  `json:"item,omitempty"`
+	ID       uint64 `json:"id,omitempty"`
+	Attempts int    `json:"attempts,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Operations of the write-ahead file's records
+const (
+	opPush = "push"
+	opFail = "fail"
+	opAck  = "ack"
+)
+
+// PermanentError wraps an error returned by a DeliverFunc to indicate that
+// delivery mustn't be retried
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+// DeliverFunc attempts to deliver a single item
+type DeliverFunc func(*Item) error
+
+// Deliver is the default DeliverFunc, it unpacks the item's action and
+// performs it (including retries according to the action's own retry policy)
+func Deliver(it *Item) error {
+	act, err := action.ToActioner(it.Action)
+	if err != nil {
+		return &PermanentError{Err: err}
+	}
+	if err := act.Run(it.Context); err != nil {
+		if !act.Retry.Retryable(err) {
+			return &PermanentError{Err: err}
+		}
+		return err
+	}
+	return nil
+}
+
+// Stats describes the current state of a Queue
+type Stats struct {
+	Depth       int           // Number of items not yet delivered
+	OldestAge   time.Duration // How long the oldest undelivered item has been queued
+	DeadLetters int           // Number of items in the dead-letter file
+}
+
+// Queue is a durable queue of actions which are delivered by worker
+// goroutines. Items which fail to be delivered are retried according to
+// Retry, and appended to the dead-letter file once they permanently fail.
+//
+// Like when actions are performed directly, the items of an alert's ordering
+// group are delivered one after the other in the order they were pushed, and
+// no more than the alert's MaxConcurrency items are delivered at once
+type Queue struct {
+	// Retry describes how often, and how many times, items are retried.
+	// Should be set before Start is called
+	Retry action.RetryPolicy
+
+	dir     string
+	deliver DeliverFunc
+
+	mu          sync.Mutex
+	cond        *sync.Cond
+	wal         *os.File
+	records     int
+	nextID      uint64
+	pending     map[uint64]*Item
+	ready       []uint64
+	deadLetters int
+	closed      bool
+	wg          sync.WaitGroup
+
+	// groups holds the pending items of each ordering group in order, only
+	// the first of which is ever ready. running counts the items of each
+	// alert being delivered, throttled holds the ready items of the alerts
+	// which are at their MaxConcurrency
+	groups    map[groupKey][]uint64
+	running   map[string]int
+	throttled map[string][]uint64
+}
+
+// Default is the queue alerts push their actions into. It's nil unless the
+// queue-dir runtime config is set, in which case actions are performed
+// directly
+var Default *Queue
+
+// Open opens the queue kept in the given directory, creating it if needed,
+// and replays any items which weren't delivered yet
+func Open(dir string, deliver DeliverFunc) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	q := &Queue{
+		dir:       dir,
+		deliver:   deliver,
+		nextID:    1,
+		pending:   map[uint64]*Item{},
+		groups:    map[groupKey][]uint64{},
+		running:   map[string]int{},
+		throttled: map[string][]uint64{},
+	}
+	q.cond = sync.NewCond(&q.mu)
+
+	if err := q.replay(); err != nil {
+		return nil, err
+	}
+	if err := q.countDeadLetters(); err != nil {
+		return nil, err
+	}
+	if err := q.compact(); err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint64, 0, len(q.pending))
+	for id := range q.pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		if q.addToGroup(q.pending[id]) {
+			q.ready = append(q.ready, id)
+		}
+	}
+	return q, nil
+}
+
+// addToGroup adds the item to the end of its ordering group, and returns
+// whether it may be made ready, i.e. it's the first item of its group or
+// doesn't have one. It must be called with mu held
+func (q *Queue) addToGroup(it *Item) bool {
+	k, ok := it.groupKey()
+	if !ok {
+		return true
+	}
+	q.groups[k] = append(q.groups[k], it.ID)
+	return len(q.groups[k]) == 1
+}
+
+// removeFromGroup removes the item from its ordering group, and returns the
+// group's next item if it should be made ready. It must be called with mu held
+func (q *Queue) removeFromGroup(it *Item) (uint64, bool) {
+	k, ok := it.groupKey()
+	if !ok {
+		return 0, false
+	}
+	ids := q.groups[k]
+	for i, id := range ids {
+		if id != it.ID {
+			continue
+		}
+		ids = append(ids[:i], ids[i+1:]...)
+		if len(ids) == 0 {
+			delete(q.groups, k)
+			return 0, false
+		}
+		q.groups[k] = ids
+		return ids[0], i == 0
+	}
+	return 0, false
+}
+
+func (q *Queue) replay() error {
+	f, err := os.Open(filepath.Join(q.dir, WALFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for sc.Scan() {
+		var r record
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			// most likely a partially written last record, which was never
+			// acknowledged to the caller anyway
+			log.LogError.WithFields(logrus.Fields{
+				"err": err,
+			}).Errorln("skipping invalid queue record")
+			continue
+		}
+		switch r.Op {
+		case opPush:
+			if r.Item == nil {
+				continue
+			}
+			q.pending[r.Item.ID] = r.Item
+			if r.Item.ID >= q.nextID {
+				q.nextID = r.Item.ID + 1
+			}
+		case opFail:
+			if it, ok := q.pending[r.ID]; ok {
+				it.Attempts = r.Attempts
+				it.LastError = r.Error
+			}
+		case opAck:
+			delete(q.pending, r.ID)
+		}
+	}
+	return sc.Err()
+}
+
+func (q *Queue) countDeadLetters() error {
+	f, err := os.Open(filepath.Join(q.dir, DeadLetterFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for sc.Scan() {
+		q.deadLetters++
+	}
+	return sc.Err()
+}
+
+// compact rewrites the write-ahead file so it only contains the pending
+// items. It must be called with mu held (or before the queue is shared)
+func (q *Queue) compact() error {
+	ids := make([]uint64, 0, len(q.pending))
+	for id := range q.pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	name := filepath.Join(q.dir, WALFile)
+	tmp, err := os.Create(name + ".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, id := range ids {
+		if err := enc.Encode(&record{Op: opPush, Item: q.pending[id]}); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+
+	if q.wal != nil {
+		q.wal.Close()
+	}
+	q.wal, err = os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+	q.records = len(ids)
+	return err
+}
+
+// appendRecord appends the record to the write-ahead file, it must be called
+// with mu held
+func (q *Queue) appendRecord(r *record) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := q.wal.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	q.records++
+	return q.wal.Sync()
+}
+
+// Push durably adds the given action to the queue, it will be performed with
+// the given context by one of the workers. maxConcurrency is the alert's
+// MaxConcurrency
+func (q *Queue) Push(act map[string]interface{}, c context.Context, maxConcurrency int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	it := &Item{
+		ID:             q.nextID,
+		Action:         act,
+		Context:        c,
+		MaxConcurrency: maxConcurrency,
+		Enqueued:       time.Now(),
+	}
+	if err := q.appendRecord(&record{Op: opPush, Item: it}); err != nil {
+		return err
+	}
+	q.nextID++
+	q.pending[it.ID] = it
+	if q.addToGroup(it) {
+		q.ready = append(q.ready, it.ID)
+		q.cond.Signal()
+	}
+	return nil
+}
+
+// Start starts the given number of worker goroutines delivering items
+func (q *Queue) Start(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+}
+
+// Close stops the workers, waiting for any in progress deliveries to finish,
+// and closes the write-ahead file. Undelivered items are kept in the file
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+
+	q.wg.Wait()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.wal.Close()
+}
+
+func (q *Queue) next() (*Item, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for !q.closed {
+		if len(q.ready) == 0 {
+			q.cond.Wait()
+			continue
+		}
+		id := q.ready[0]
+		q.ready = q.ready[1:]
+		p, ok := q.pending[id]
+		if !ok {
+			continue
+		}
+		name := p.Context.Name
+		if p.MaxConcurrency > 0 && q.running[name] >= p.MaxConcurrency {
+			// made ready again once one of the alert's items is done
+			q.throttled[name] = append(q.throttled[name], id)
+			continue
+		}
+		q.running[name]++
+		// copy the item so it can be used outside of the lock
+		it := *p
+		return &it, true
+	}
+	return nil, false
+}
+
+func (q *Queue) work() {
+	defer q.wg.Done()
+	for {
+		it, ok := q.next()
+		if !ok {
+			return
+		}
+		q.done(it, q.deliver(it))
+	}
+}
+
+func (q *Queue) done(it *Item, err error) {
+	kv := logrus.Fields{
+		"name":     it.Context.Name,
+		"action":   it.Action["type"],
+		"queueID":  it.ID,
+		"attempts": it.Attempts + 1,
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	name := it.Context.Name
+	if q.running[name]--; q.running[name] <= 0 {
+		delete(q.running, name)
+	}
+	if ids := q.throttled[name]; len(ids) > 0 {
+		q.ready = append(q.ready, ids[0])
+		if len(ids) == 1 {
+			delete(q.throttled, name)
+		} else {
+			q.throttled[name] = ids[1:]
+		}
+		q.cond.Signal()
+	}
+
+	if err == nil {
+		q.ack(it.ID)
+		return
+	}
+
+	kv["err"] = err
+	it.Attempts++
+	it.LastError = err.Error()
+	_, permanent := err.(*PermanentError)
+	if permanent || it.Attempts >= q.Retry.MaxAttempts {
+		log.LogError.WithFields(kv).Errorln("failed to deliver queued action, moving it to the dead-letter file")
+		if err := q.deadLetter(it); err != nil {
+			// keep the item, so it isn't lost, and try again later
+			kv["err"] = err
+			log.LogError.WithFields(kv).Errorln("failed to write dead-letter file, retrying later")
+			q.retryLater(it)
+			return
+		}
+		q.ack(it.ID)
+		return
+	}
+
+	log.LogError.WithFields(kv).Warnln("failed to deliver queued action, retrying later")
+	if err := q.appendRecord(&record{Op: opFail, ID: it.ID, Attempts: it.Attempts, Error: it.LastError}); err != nil {
+		kv["err"] = err
+		log.LogError.WithFields(kv).Errorln("failed to write queue record")
+	}
+	q.retryLater(it)
+}
+
+// retryLater records the failed attempt at delivering the item, and makes it
+// ready again after the retry backoff. It must be called with mu held
+func (q *Queue) retryLater(it *Item) {
+	if p, ok := q.pending[it.ID]; ok {
+		p.Attempts = it.Attempts
+		p.LastError = it.LastError
+	}
+
+	id := it.ID
+	time.AfterFunc(q.Retry.Wait(it.Attempts+1), func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if _, ok := q.pending[id]; ok && !q.closed {
+			q.ready = append(q.ready, id)
+			q.cond.Signal()
+		}
+	})
+}
+
+// ack removes the item from the queue, making the next item of its ordering
+// group ready. It must be called with mu held
+func (q *Queue) ack(id uint64) {
+	if it, ok := q.pending[id]; ok {
+		delete(q.pending, id)
+		if next, ok := q.removeFromGroup(it); ok {
+			q.ready = append(q.ready, next)
+			q.cond.Signal()
+		}
+	}
+
+	var err error
+	if len(q.pending) == 0 || q.records >= compactAfter {
+		err = q.compact()
+	} else {
+		err = q.appendRecord(&record{Op: opAck, ID: id})
+	}
+	if err != nil {
+		log.LogError.WithFields(logrus.Fields{
+			"queueID": id,
+			"err":     err,
+		}).Errorln("failed to write queue record")
+	}
+}
+
+// deadLetter appends the item to the dead-letter file, it must be called with
+// mu held
+func (q *Queue) deadLetter(it *Item) error {
+	f, err := os.OpenFile(filepath.Join(q.dir, DeadLetterFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	b, err := json.Marshal(it)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	q.deadLetters++
+	return nil
+}
+
+// Stats returns the current state of the queue
+func (q *Queue) Stats() Stats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	s := Stats{
+		Depth:       len(q.pending),
+		DeadLetters: q.deadLetters,
+	}
+	now := time.Now()
+	for _, it := range q.pending {
+		if age := now.Sub(it.Enqueued); age > s.OldestAge {
+			s.OldestAge = age
+		}
+	}
+	return s
+}
@@ -0,0 +1,183 @@
+package queue_test
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tengattack/esalert/action"
+	"github.com/tengattack/esalert/context"
+	"github.com/tengattack/esalert/queue"
+)
+
+type recorder struct {
+	sync.Mutex
+	fail      map[string]error
+	delivered []string
+}
+
+func (r *recorder) deliver(it *queue.Item) error {
+	r.Lock()
+	defer r.Unlock()
+	msg := it.Action["message"].(string)
+	if err := r.fail[msg]; err != nil {
+		return err
+	}
+	r.delivered = append(r.delivered, msg)
+	return nil
+}
+
+func (r *recorder) get() []string {
+	r.Lock()
+	defer r.Unlock()
+	return append([]string(nil), r.delivered...)
+}
+
+func countLines(t *testing.T, name string) int {
+	f, err := os.Open(name)
+	require.Nil(t, err)
+	defer f.Close()
+	var n int
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		n++
+	}
+	return n
+}
+
+func TestQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	r := &recorder{fail: map[string]error{
+		"down":      errors.New("connection refused"),
+		"permanent": &queue.PermanentError{Err: errors.New("bad request")},
+	}}
+
+	// items pushed while no workers are running are kept across restarts
+	q, err := queue.Open(dir, r.deliver)
+	require.Nil(t, err)
+	c := context.Context{Name: "wat"}
+	for _, msg := range []string{"foo", "down", "permanent"} {
+		require.Nil(t, q.Push(map[string]interface{}{"type": "log", "message": msg}, c, 0))
+	}
+	assert.Equal(t, 3, q.Stats().Depth)
+	require.Nil(t, q.Close())
+
+	q, err = queue.Open(dir, r.deliver)
+	require.Nil(t, err)
+	assert.Equal(t, 3, q.Stats().Depth)
+	q.Retry = action.RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	q.Start(2)
+
+	require.Eventually(t, func() bool {
+		s := q.Stats()
+		return s.Depth == 0 && s.DeadLetters == 2
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"foo"}, r.get())
+	require.Nil(t, q.Close())
+	assert.Equal(t, 2, countLines(t, filepath.Join(dir, queue.DeadLetterFile)))
+	assert.Equal(t, 0, countLines(t, filepath.Join(dir, queue.WALFile)))
+
+	q, err = queue.Open(dir, r.deliver)
+	require.Nil(t, err)
+	assert.Equal(t, queue.Stats{DeadLetters: 2}, q.Stats())
+	require.Nil(t, q.Close())
+}
+
+func TestQueueOrdering(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	var delivered []string
+	running, maxRunning := map[string]int{}, map[string]int{}
+	failures := 2
+	deliver := func(it *queue.Item) error {
+		name := it.Context.Name
+		mu.Lock()
+		if running[name]++; running[name] > maxRunning[name] {
+			maxRunning[name] = running[name]
+		}
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+
+		mu.Lock()
+		defer mu.Unlock()
+		running[name]--
+		msg := it.Action["message"].(string)
+		if msg == "first" && failures > 0 {
+			failures--
+			return errors.New("connection refused")
+		}
+		delivered = append(delivered, msg)
+		return nil
+	}
+
+	q, err := queue.Open(dir, deliver)
+	require.Nil(t, err)
+	q.Retry = action.RetryPolicy{MaxAttempts: 5, Backoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	for _, msg := range []string{"first", "second"} {
+		act := map[string]interface{}{"type": "log", "message": msg, "group": "g"}
+		require.Nil(t, q.Push(act, context.Context{Name: "ordered"}, 0))
+	}
+	for _, msg := range []string{"a", "b", "c", "d", "e"} {
+		act := map[string]interface{}{"type": "log", "message": msg}
+		require.Nil(t, q.Push(act, context.Context{Name: "limited"}, 2))
+	}
+	q.Start(8)
+
+	require.Eventually(t, func() bool { return q.Stats().Depth == 0 }, time.Second, time.Millisecond)
+	require.Nil(t, q.Close())
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, delivered, 7)
+	var order []string
+	for _, msg := range delivered {
+		if msg == "first" || msg == "second" {
+			order = append(order, msg)
+		}
+	}
+	// second waited for first to be retried
+	assert.Equal(t, []string{"first", "second"}, order)
+	assert.Equal(t, 1, maxRunning["ordered"])
+	assert.Equal(t, 2, maxRunning["limited"])
+}
+
+func TestQueueDeadLetterFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	r := &recorder{fail: map[string]error{
+		"permanent": &queue.PermanentError{Err: errors.New("bad request")},
+	}}
+	q, err := queue.Open(dir, r.deliver)
+	require.Nil(t, err)
+	q.Retry = action.RetryPolicy{MaxAttempts: 1, Backoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	// the dead-letter file can't be written while it's a directory
+	deadLetters := filepath.Join(dir, queue.DeadLetterFile)
+	require.Nil(t, os.Mkdir(deadLetters, 0755))
+	require.Nil(t, q.Push(map[string]interface{}{"type": "log", "message": "permanent"}, context.Context{Name: "wat"}, 0))
+	q.Start(1)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 1, q.Stats().Depth)
+
+	require.Nil(t, os.Remove(deadLetters))
+	require.Eventually(t, func() bool {
+		s := q.Stats()
+		return s.Depth == 0 && s.DeadLetters == 1
+	}, time.Second, time.Millisecond)
+	require.Nil(t, q.Close())
+}
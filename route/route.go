@@ -0,0 +1,251 @@
+// Package route routes notifications, described by their labels, to the
+// receivers defined in the runtime config
+package route
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/tengattack/esalert/action"
+	"github.com/tengattack/esalert/config"
+)
+
+type route struct {
+	receiver string
+	match    map[string]string
+	matchRE  map[string]*regexp.Regexp
+	cont     bool
+	routes   []*route
+}
+
+// Grouping describes how the notifications sent to a receiver are grouped.
+// Notifications whose By labels are equal are buffered for Wait, or until
+// the next multiple of DigestInterval if it's set, and then sent together
+type Grouping struct {
+	By             []string
+	Wait           time.Duration
+	DigestInterval time.Duration
+}
+
+type receiver struct {
+	actions  []map[string]interface{}
+	grouping Grouping
+}
+
+var (
+	receivers map[string]*receiver
+	root      *route
+)
+
+// Load validates the given receivers and routing tree, and makes them the
+// ones used by Match and Actions. It must be called before any alerts are run
+func Load(rcvs []config.Receiver, r config.Route) error {
+	m := make(map[string]*receiver, len(rcvs))
+	for _, rcv := range rcvs {
+		if rcv.Name == "" {
+			return errors.New("receiver without name")
+		}
+		if _, ok := m[rcv.Name]; ok {
+			return fmt.Errorf("duplicate receiver %q", rcv.Name)
+		}
+		defs := make([]map[string]interface{}, len(rcv.Actions))
+		for i := range rcv.Actions {
+			def, ok := plain(rcv.Actions[i]).(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("receiver %q action %d is not an object", rcv.Name, i)
+			}
+			if _, ok := def["template"]; !ok {
+				// receiver actions are always rendered, unless they
+				// explicitly opt out
+				def["template"] = true
+			}
+			if _, err := action.ToActioner(def); err != nil {
+				return fmt.Errorf("receiver %q action %d: %s", rcv.Name, i, err)
+			}
+			defs[i] = def
+		}
+		rc := &receiver{
+			actions:  defs,
+			grouping: Grouping{By: rcv.GroupBy},
+		}
+		var err error
+		if rcv.GroupWait != "" {
+			if rc.grouping.Wait, err = time.ParseDuration(rcv.GroupWait); err != nil {
+				return fmt.Errorf("receiver %q group_wait: %s", rcv.Name, err)
+			}
+		}
+		if rcv.DigestInterval != "" {
+			if rc.grouping.DigestInterval, err = time.ParseDuration(rcv.DigestInterval); err != nil {
+				return fmt.Errorf("receiver %q digest_interval: %s", rcv.Name, err)
+			}
+		}
+		m[rcv.Name] = rc
+	}
+
+	var rt *route
+	if len(m) > 0 {
+		if r.Receiver == "" {
+			return errors.New("root route has no receiver")
+		}
+		var err error
+		if rt, err = newRoute(r, "", m); err != nil {
+			return err
+		}
+	}
+
+	receivers, root = m, rt
+	return nil
+}
+
+func newRoute(r config.Route, parentReceiver string, rcvs map[string]*receiver) (*route, error) {
+	rt := &route{
+		receiver: r.Receiver,
+		match:    r.Match,
+		matchRE:  make(map[string]*regexp.Regexp, len(r.MatchRE)),
+		cont:     r.Continue,
+	}
+	if rt.receiver == "" {
+		rt.receiver = parentReceiver
+	}
+	if _, ok := rcvs[rt.receiver]; !ok {
+		return nil, fmt.Errorf("route has unknown receiver %q", rt.receiver)
+	}
+
+	for k, v := range r.MatchRE {
+		re, err := regexp.Compile("^(?:" + v + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("route match_re %s: %s", k, err)
+		}
+		rt.matchRE[k] = re
+	}
+
+	for _, child := range r.Routes {
+		crt, err := newRoute(child, rt.receiver, rcvs)
+		if err != nil {
+			return nil, err
+		}
+		rt.routes = append(rt.routes, crt)
+	}
+	return rt, nil
+}
+
+func (r *route) matches(labels map[string]string) bool {
+	for k, v := range r.match {
+		if labels[k] != v {
+			return false
+		}
+	}
+	for k, re := range r.matchRE {
+		if !re.MatchString(labels[k]) {
+			return false
+		}
+	}
+	return true
+}
+
+// find returns the receivers of the deepest matching routes, or nil if the
+// route itself doesn't match
+func (r *route) find(labels map[string]string) []string {
+	if !r.matches(labels) {
+		return nil
+	}
+	var res []string
+	for _, child := range r.routes {
+		if m := child.find(labels); len(m) > 0 {
+			res = append(res, m...)
+			if !child.cont {
+				break
+			}
+		}
+	}
+	if len(res) == 0 {
+		res = []string{r.receiver}
+	}
+	return res
+}
+
+// Enabled returns whether any receivers were loaded
+func Enabled() bool {
+	return root != nil
+}
+
+// Match returns the names of the receivers a notification with the given
+// labels is routed to. Like in Alertmanager, the routing tree is walked depth
+// first, and the receiver of the deepest matching route is used. Siblings
+// after a matching route are only tried if it has continue set
+func Match(labels map[string]string) []string {
+	if root == nil {
+		return nil
+	}
+	var res []string
+	seen := map[string]bool{}
+	for _, name := range root.find(labels) {
+		if !seen[name] {
+			seen[name] = true
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+// HasReceiver returns whether a receiver with the given name was loaded
+func HasReceiver(name string) bool {
+	_, ok := receivers[name]
+	return ok
+}
+
+// Actions returns copies of the action definitions of the named receiver
+func Actions(name string) []interface{} {
+	var defs []map[string]interface{}
+	if rc, ok := receivers[name]; ok {
+		defs = rc.actions
+	}
+	res := make([]interface{}, len(defs))
+	for i := range defs {
+		def := make(map[string]interface{}, len(defs[i]))
+		for k, v := range defs[i] {
+			def[k] = v
+		}
+		res[i] = def
+	}
+	return res
+}
+
+// GroupingOf returns how the notifications sent to the named receiver are
+// grouped, and false if they aren't
+func GroupingOf(name string) (Grouping, bool) {
+	rc, ok := receivers[name]
+	if !ok || (rc.grouping.Wait <= 0 && rc.grouping.DigestInterval <= 0) {
+		return Grouping{}, false
+	}
+	return rc.grouping, true
+}
+
+// plain converts the maps yaml decodes nested objects into into
+// map[string]interface{}, which is what actions are unpacked from
+func plain(v interface{}) interface{} {
+	switch vv := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(vv))
+		for k, vi := range vv {
+			m[fmt.Sprint(k)] = plain(vi)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(vv))
+		for k, vi := range vv {
+			m[k] = plain(vi)
+		}
+		return m
+	case []interface{}:
+		out := make([]interface{}, len(vv))
+		for i := range vv {
+			out[i] = plain(vv[i])
+		}
+		return out
+	default:
+		return v
+	}
+}
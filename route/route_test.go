@@ -0,0 +1,93 @@
+package route_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tengattack/esalert/config"
+	"github.com/tengattack/esalert/route"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func load(t *testing.T, y string) error {
+	var opts struct {
+		Receivers []config.Receiver `yaml:"receivers"`
+		Route     config.Route      `yaml:"route"`
+	}
+	require.Nil(t, yaml.Unmarshal([]byte(y), &opts))
+	return route.Load(opts.Receivers, opts.Route)
+}
+
+func TestMatch(t *testing.T) {
+	defer route.Load(nil, config.Route{})
+
+	require.Nil(t, load(t, `
+receivers:
+  - name: default
+    actions:
+      - type: log
+        message: "{{.Name}}"
+  - name: oncall
+    actions:
+      - type: http
+        method: POST
+        url: http://example.com/page
+        headers:
+          X-Team: payments
+  - name: payments
+  - name: db
+route:
+  receiver: default
+  routes:
+    - match:
+        severity: critical
+      receiver: oncall
+      continue: true
+    - match_re:
+        team: pay.*
+      receiver: payments
+      routes:
+        - match:
+            service: db
+          receiver: db
+    - match:
+        team: payments
+      receiver: oncall
+`))
+	assert.True(t, route.Enabled())
+
+	assert.Equal(t, []string{"default"}, route.Match(map[string]string{"alertname": "wat"}))
+	assert.Equal(t, []string{"oncall", "payments"}, route.Match(map[string]string{"severity": "critical", "team": "payments"}))
+	assert.Equal(t, []string{"db"}, route.Match(map[string]string{"team": "payments", "service": "db"}))
+	assert.Equal(t, []string{"default"}, route.Match(map[string]string{"team": "xpayments"}))
+
+	acts := route.Actions("oncall")
+	require.Len(t, acts, 1)
+	act := acts[0].(map[string]interface{})
+	assert.Equal(t, true, act["template"])
+	assert.Equal(t, map[string]interface{}{"X-Team": "payments"}, act["headers"])
+	// the returned actions are copies
+	act["url"] = "nope"
+	assert.Equal(t, "http://example.com/page", route.Actions("oncall")[0].(map[string]interface{})["url"])
+}
+
+func TestLoadErrors(t *testing.T) {
+	defer route.Load(nil, config.Route{})
+
+	for _, y := range []string{
+		"receivers: [{name: a}, {name: a}]\nroute: {receiver: a}",
+		"receivers: [{name: a}]\nroute: {}",
+		"receivers: [{name: a}]\nroute: {receiver: b}",
+		"receivers: [{name: a}]\nroute: {receiver: a, routes: [{receiver: b}]}",
+		"receivers: [{name: a}]\nroute: {receiver: a, match_re: {team: '('}}",
+		"receivers: [{name: a, actions: [{type: nope}]}]\nroute: {receiver: a}",
+		"receivers: [{name: a, group_wait: nope}]\nroute: {receiver: a}",
+	} {
+		assert.NotNil(t, load(t, y), y)
+	}
+
+	require.Nil(t, load(t, ""))
+	assert.False(t, route.Enabled())
+	assert.Nil(t, route.Match(map[string]string{"alertname": "wat"}))
+}
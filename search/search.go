@@ -3,11 +3,13 @@ package search
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 	"github.com/tengattack/esalert/config"
@@ -38,6 +40,21 @@ type Result struct {
 	Aggregations map[string]interface{}          `json:"aggregations"` // Information related to aggregations in the query
 }
 
+// StatusError is returned when elasticsearch responds with a non 2xx status
+// code, either to a whole request or to a single item of a bulk request.
+// Reason is the error elasticsearch gave, if any
+type StatusError struct {
+	StatusCode int
+	Reason     string
+}
+
+func (e *StatusError) Error() string {
+	if e.Reason != "" {
+		return e.Reason
+	}
+	return fmt.Sprintf("HTTP status code: %v", e.StatusCode)
+}
+
 type elasticError struct {
 	Error string `json:"reason"`
 }
@@ -96,39 +113,60 @@ func mapToDict(m map[interface{}]interface{}) (Dict, error) {
 	return d, nil
 }
 
-// Search performs a search against the given elasticsearch index for
-// documents of the given type. The search must json marshal into a valid
-// elasticsearch request body query
-// (see https://www.elastic.co/guide/en/elasticsearch/reference/current/search-request-body.html)
-func Search(index, typ string, search interface{}) (Result, error) {
-	u := fmt.Sprintf("http://%s/%s/%s/_search", config.Opts.ElasticSearchAddr, index, typ)
-	bodyReq, err := json.Marshal(search)
+// request performs an http request against the configured elasticsearch
+// instance, using the configured credentials, and returns the response's
+// status code and body. The request is aborted once ctx is done
+func request(ctx context.Context, method, path, contentType string, body []byte) (int, []byte, error) {
+	u := fmt.Sprintf("http://%s/%s", config.Opts.ElasticSearchAddr, strings.TrimLeft(path, "/"))
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewBuffer(body))
 	if err != nil {
-		return Result{}, err
+		return 0, nil, err
 	}
 
-	log.LogAccess.WithFields(logrus.Fields{
-		"body": string(bodyReq),
-	}).Debugln("search query")
+	if config.Opts.ElasticSearchUser != "" && config.Opts.ElasticSearchPass != "" {
+		req.SetBasicAuth(config.Opts.ElasticSearchUser, config.Opts.ElasticSearchPass)
+	}
 
-	req, err := http.NewRequest(http.MethodPost, u, bytes.NewBuffer(bodyReq))
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return Result{}, err
+		return 0, nil, err
 	}
+	defer resp.Body.Close()
 
-	if config.Opts.ElasticSearchUser != "" && config.Opts.ElasticSearchPass != "" {
-		req.SetBasicAuth(config.Opts.ElasticSearchUser, config.Opts.ElasticSearchPass)
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
 	}
+	return resp.StatusCode, respBody, nil
+}
 
-	req.Header.Set("Content-Type", "application/json")
+// Search performs a search against the given elasticsearch index for
+// documents of the given type. The search must json marshal into a valid
+// elasticsearch request body query
+// (see https://www.elastic.co/guide/en/elasticsearch/reference/current/search-request-body.html)
+func Search(index, typ string, search interface{}) (Result, error) {
+	return doSearch(context.Background(), fmt.Sprintf("%s/%s/_search", index, typ), search)
+}
 
-	resp, err := http.DefaultClient.Do(req)
+// SearchIndex is like Search, but searches documents of any type in the
+// index, and is aborted once ctx is done
+func SearchIndex(ctx context.Context, index string, search interface{}) (Result, error) {
+	return doSearch(ctx, index+"/_search", search)
+}
+
+func doSearch(ctx context.Context, path string, search interface{}) (Result, error) {
+	bodyReq, err := json.Marshal(search)
 	if err != nil {
 		return Result{}, err
 	}
-	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	log.LogAccess.WithFields(logrus.Fields{
+		"body": string(bodyReq),
+	}).Debugln("search query")
+
+	statusCode, body, err := request(ctx, http.MethodPost, path, "application/json", bodyReq)
 	if err != nil {
 		return Result{}, err
 	}
@@ -137,13 +175,13 @@ func Search(index, typ string, search interface{}) (Result, error) {
 		"body": string(body),
 	}).Debugln("search results")
 
-	if resp.StatusCode != 200 {
+	if statusCode != 200 {
 		var e elasticError
 		if err := json.Unmarshal(body, &e); err != nil {
 			log.LogError.Errorf("could not unmarshal error body, %v", err)
 			return Result{}, err
 		}
-		return Result{}, errors.New(fmt.Sprintf("HTTP status code: %v", resp.StatusCode))
+		return Result{}, &StatusError{StatusCode: statusCode}
 	}
 
 	var result Result
@@ -158,3 +196,193 @@ func Search(index, typ string, search interface{}) (Result, error) {
 
 	return result, nil
 }
+
+// Count returns the number of documents in the given elasticsearch index
+// matching the query, which must json marshal into a valid count request body.
+// A nil query counts all documents. The request is aborted once ctx is done
+// (see https://www.elastic.co/guide/en/elasticsearch/reference/current/search-count.html)
+func Count(ctx context.Context, index string, query interface{}) (uint64, error) {
+	var bodyReq []byte
+	if query != nil {
+		var err error
+		if bodyReq, err = json.Marshal(query); err != nil {
+			return 0, err
+		}
+	}
+
+	statusCode, body, err := request(ctx, http.MethodPost, index+"/_count", "application/json", bodyReq)
+	if err != nil {
+		return 0, err
+	}
+
+	log.LogAccess.WithFields(logrus.Fields{
+		"body": string(body),
+	}).Debugln("count results")
+
+	if statusCode != 200 {
+		return 0, &StatusError{StatusCode: statusCode}
+	}
+
+	var res struct {
+		Count uint64 `json:"count"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return 0, err
+	}
+	return res.Count, nil
+}
+
+// MSearchItem describes a single search to be performed by MSearch
+type MSearchItem struct {
+	Index string      // The index to search in
+	Type  string      // The type of the documents, may be empty
+	Query interface{} // The search, must json marshal into a valid request body query
+}
+
+type msearchHeader struct {
+	Index string `json:"index"`
+	Type  string `json:"type,omitempty"`
+}
+
+type msearchResponse struct {
+	Responses []json.RawMessage `json:"responses"`
+}
+
+// MSearch performs all the given searches with a single multi search request
+// (see https://www.elastic.co/guide/en/elasticsearch/reference/current/search-multi-search.html).
+// If the request as a whole fails an error is returned, otherwise the returned
+// slices hold the result or error of each search, in the same order as items.
+// The request is aborted once ctx is done
+func MSearch(ctx context.Context, items []MSearchItem) ([]Result, []error, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+	enc := json.NewEncoder(buf)
+	for _, item := range items {
+		if err := enc.Encode(msearchHeader{Index: item.Index, Type: item.Type}); err != nil {
+			return nil, nil, err
+		}
+		if err := enc.Encode(item.Query); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	statusCode, body, err := request(ctx, http.MethodPost, "_msearch", "application/x-ndjson", buf.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log.LogAccess.WithFields(logrus.Fields{
+		"body": string(body),
+	}).Debugln("msearch results")
+
+	if statusCode != 200 {
+		return nil, nil, &StatusError{StatusCode: statusCode}
+	}
+
+	var resp msearchResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, nil, err
+	}
+	if len(resp.Responses) != len(items) {
+		return nil, nil, fmt.Errorf("msearch response has %d responses, expected %d", len(resp.Responses), len(items))
+	}
+
+	results := make([]Result, len(items))
+	errs := make([]error, len(items))
+	for i, raw := range resp.Responses {
+		var e struct {
+			Error *struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(raw, &e); err != nil {
+			errs[i] = err
+		} else if e.Error != nil {
+			errs[i] = fmt.Errorf("%s: %s", e.Error.Type, e.Error.Reason)
+		} else if err := json.Unmarshal(raw, &results[i]); err != nil {
+			errs[i] = err
+		} else if results[i].TimedOut {
+			errs[i] = errors.New("search timed out in elasticsearch")
+		}
+	}
+	return results, errs, nil
+}
+
+// BulkItem describes a single document to be indexed by Bulk
+type BulkItem struct {
+	Index string      // The index the document will be written into
+	Type  string      // The type of the document, may be empty
+	Doc   interface{} // The actual document, must json marshal into an object
+}
+
+type bulkAction struct {
+	Index string `json:"_index"`
+	Type  string `json:"_type,omitempty"`
+}
+
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  *struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+// Bulk indexes all the given documents into elasticsearch with a single bulk
+// request (see https://www.elastic.co/guide/en/elasticsearch/reference/current/docs-bulk.html).
+// If the request as a whole fails an error is returned, otherwise the returned
+// slice holds the result of indexing each item, in the same order as items
+func Bulk(items []BulkItem) ([]error, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+	enc := json.NewEncoder(buf)
+	for _, item := range items {
+		if err := enc.Encode(map[string]bulkAction{
+			"index": {Index: item.Index, Type: item.Type},
+		}); err != nil {
+			return nil, err
+		}
+		if err := enc.Encode(item.Doc); err != nil {
+			return nil, err
+		}
+	}
+
+	statusCode, body, err := request(context.Background(), http.MethodPost, "_bulk", "application/x-ndjson", buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	log.LogAccess.WithFields(logrus.Fields{
+		"body": string(body),
+	}).Debugln("bulk results")
+
+	if statusCode != 200 {
+		return nil, &StatusError{StatusCode: statusCode}
+	}
+
+	var resp bulkResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Items) != len(items) {
+		return nil, fmt.Errorf("bulk response has %d items, expected %d", len(resp.Items), len(items))
+	}
+
+	errs := make([]error, len(items))
+	for i := range resp.Items {
+		for _, res := range resp.Items[i] {
+			if res.Status < 200 || res.Status > 299 {
+				se := &StatusError{StatusCode: res.Status}
+				if res.Error != nil {
+					se.Reason = fmt.Sprintf("%s: %s", res.Error.Type, res.Error.Reason)
+				}
+				errs[i] = se
+			} else if res.Error != nil {
+				errs[i] = fmt.Errorf("%s: %s", res.Error.Type, res.Error.Reason)
+			}
+		}
+	}
+	return errs, nil
+}
@@ -0,0 +1,264 @@
+// Package silence implements silences, which mute the notifications of
+// matching alerts for a period of time, e.g. during maintenance windows.
+// Silences are persisted to a json file, so they survive restarts.
+package silence
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Matcher matches a single label of a notification, alert names are matched
+// as the alertname label
+type Matcher struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	IsRegex bool   `json:"is_regex,omitempty"`
+
+	re *regexp.Regexp
+}
+
+func (m *Matcher) init() error {
+	if m.Name == "" {
+		return errors.New("matcher without name")
+	}
+	if !m.IsRegex {
+		return nil
+	}
+	re, err := regexp.Compile("^(?:" + m.Value + ")$")
+	if err != nil {
+		return fmt.Errorf("matcher %s: %s", m.Name, err)
+	}
+	m.re = re
+	return nil
+}
+
+func (m *Matcher) matches(labels map[string]string) bool {
+	if m.re != nil {
+		return m.re.MatchString(labels[m.Name])
+	}
+	return labels[m.Name] == m.Value
+}
+
+// Silence mutes the notifications whose labels match all of its Matchers,
+// between StartsAt and EndsAt
+type Silence struct {
+	ID        string    `json:"id"`
+	Matchers  []Matcher `json:"matchers"`
+	StartsAt  time.Time `json:"starts_at"`
+	EndsAt    time.Time `json:"ends_at"`
+	CreatedBy string    `json:"created_by"`
+	Comment   string    `json:"comment,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Active returns whether the silence is in effect at the given time
+func (s *Silence) Active(now time.Time) bool {
+	return !now.Before(s.StartsAt) && now.Before(s.EndsAt)
+}
+
+// Matches returns whether the silence's matchers all match the given labels
+func (s *Silence) Matches(labels map[string]string) bool {
+	for i := range s.Matchers {
+		if !s.Matchers[i].matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Silence) validate() error {
+	if len(s.Matchers) == 0 {
+		return errors.New("silence has no matchers")
+	}
+	for i := range s.Matchers {
+		if err := s.Matchers[i].init(); err != nil {
+			return err
+		}
+	}
+	if s.EndsAt.IsZero() {
+		return errors.New("silence has no end time")
+	}
+	if !s.EndsAt.After(s.StartsAt) {
+		return errors.New("silence ends before it starts")
+	}
+	if s.CreatedBy == "" {
+		return errors.New("silence has no author")
+	}
+	return nil
+}
+
+// Store is a set of silences persisted to a file
+type Store struct {
+	file string
+
+	mu       sync.RWMutex
+	silences map[string]*Silence
+}
+
+// Default is the store alerts are checked against. It's nil unless the
+// silence-file runtime config is set
+var Default *Store
+
+// Open opens the store persisted to the given file, the file is created once
+// the first silence is added. Silences which already ended are dropped
+func Open(file string) (*Store, error) {
+	s := &Store{
+		file:     file,
+		silences: map[string]*Silence{},
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var silences []*Silence
+	if err := json.Unmarshal(b, &silences); err != nil {
+		return nil, fmt.Errorf("parsing %s: %s", file, err)
+	}
+	now := time.Now()
+	for _, sl := range silences {
+		if err := sl.validate(); err != nil {
+			return nil, fmt.Errorf("silence %s: %s", sl.ID, err)
+		}
+		if now.Before(sl.EndsAt) {
+			s.silences[sl.ID] = sl
+		}
+	}
+	return s, nil
+}
+
+// save writes the silences to the file, it must be called with mu held
+func (s *Store) save() error {
+	b, err := json.MarshalIndent(s.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file)
+}
+
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Add validates the given silence and adds it to the store. Its ID and
+// CreatedAt are set, and StartsAt defaults to now
+func (s *Store) Add(sl Silence) (Silence, error) {
+	now := time.Now()
+	if sl.StartsAt.IsZero() {
+		sl.StartsAt = now
+	}
+	sl.CreatedAt = now
+	sl.Matchers = append([]Matcher(nil), sl.Matchers...)
+	if err := sl.validate(); err != nil {
+		return Silence{}, err
+	}
+	if !now.Before(sl.EndsAt) {
+		return Silence{}, errors.New("silence already ended")
+	}
+	id, err := newID()
+	if err != nil {
+		return Silence{}, err
+	}
+	sl.ID = id
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(now)
+	s.silences[sl.ID] = &sl
+	if err := s.save(); err != nil {
+		delete(s.silences, sl.ID)
+		return Silence{}, err
+	}
+	return sl, nil
+}
+
+// Expire removes the silence with the given ID, it returns false if there's
+// no such silence
+func (s *Store) Expire(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sl, ok := s.silences[id]
+	if !ok {
+		return false, nil
+	}
+	delete(s.silences, id)
+	if err := s.save(); err != nil {
+		s.silences[id] = sl
+		return true, err
+	}
+	return true, nil
+}
+
+// prune drops the silences which ended, it must be called with mu held
+func (s *Store) prune(now time.Time) {
+	for id, sl := range s.silences {
+		if !now.Before(sl.EndsAt) {
+			delete(s.silences, id)
+		}
+	}
+}
+
+// list must be called with mu held
+func (s *Store) list() []Silence {
+	res := make([]Silence, 0, len(s.silences))
+	for _, sl := range s.silences {
+		res = append(res, *sl)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if !res[i].StartsAt.Equal(res[j].StartsAt) {
+			return res[i].StartsAt.Before(res[j].StartsAt)
+		}
+		return res[i].ID < res[j].ID
+	})
+	return res
+}
+
+// List returns the silences which haven't ended yet, ordered by start time
+func (s *Store) List() []Silence {
+	now := time.Now()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res := s.list()
+	n := 0
+	for _, sl := range res {
+		if now.Before(sl.EndsAt) {
+			res[n] = sl
+			n++
+		}
+	}
+	return res[:n]
+}
+
+// Silenced returns the active silence matching the given labels at the given
+// time, if any
+func (s *Store) Silenced(labels map[string]string, now time.Time) (Silence, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, sl := range s.list() {
+		if sl.Active(now) && sl.Matches(labels) {
+			return sl, true
+		}
+	}
+	return Silence{}, false
+}
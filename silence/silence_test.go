@@ -0,0 +1,88 @@
+package silence_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tengattack/esalert/silence"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "esalert-silence")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "silences.json")
+
+	s, err := silence.Open(file)
+	require.Nil(t, err)
+	assert.Empty(t, s.List())
+
+	now := time.Now()
+	sl, err := s.Add(silence.Silence{
+		Matchers: []silence.Matcher{
+			{Name: "alertname", Value: "wat"},
+			{Name: "team", Value: "pay.*", IsRegex: true},
+		},
+		EndsAt:    now.Add(time.Hour),
+		CreatedBy: "someone",
+		Comment:   "maintenance",
+	})
+	require.Nil(t, err)
+	assert.NotEmpty(t, sl.ID)
+	assert.False(t, sl.StartsAt.IsZero())
+
+	_, err = s.Add(silence.Silence{
+		Matchers:  []silence.Matcher{{Name: "alertname", Value: "later"}},
+		StartsAt:  now.Add(time.Hour),
+		EndsAt:    now.Add(2 * time.Hour),
+		CreatedBy: "someone",
+	})
+	require.Nil(t, err)
+
+	got, ok := s.Silenced(map[string]string{"alertname": "wat", "team": "payments"}, now.Add(time.Minute))
+	assert.True(t, ok)
+	assert.Equal(t, sl.ID, got.ID)
+	_, ok = s.Silenced(map[string]string{"alertname": "wat", "team": "xpayments"}, now.Add(time.Minute))
+	assert.False(t, ok)
+	_, ok = s.Silenced(map[string]string{"alertname": "wat", "team": "payments"}, now.Add(2*time.Hour))
+	assert.False(t, ok)
+	_, ok = s.Silenced(map[string]string{"alertname": "later"}, now.Add(time.Minute))
+	assert.False(t, ok)
+	_, ok = s.Silenced(map[string]string{"alertname": "later"}, now.Add(90*time.Minute))
+	assert.True(t, ok)
+
+	// silences are persisted
+	s, err = silence.Open(file)
+	require.Nil(t, err)
+	require.Len(t, s.List(), 2)
+	_, ok = s.Silenced(map[string]string{"alertname": "wat", "team": "payments"}, now.Add(time.Minute))
+	assert.True(t, ok)
+
+	ok, err = s.Expire(sl.ID)
+	require.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = s.Expire(sl.ID)
+	require.Nil(t, err)
+	assert.False(t, ok)
+
+	s, err = silence.Open(file)
+	require.Nil(t, err)
+	assert.Len(t, s.List(), 1)
+
+	for _, invalid := range []silence.Silence{
+		{EndsAt: now.Add(time.Hour), CreatedBy: "someone"},
+		{Matchers: []silence.Matcher{{Name: "a", Value: "b"}}, CreatedBy: "someone"},
+		{Matchers: []silence.Matcher{{Name: "a", Value: "b"}}, EndsAt: now.Add(time.Hour)},
+		{Matchers: []silence.Matcher{{Value: "b"}}, EndsAt: now.Add(time.Hour), CreatedBy: "someone"},
+		{Matchers: []silence.Matcher{{Name: "a", Value: "(", IsRegex: true}}, EndsAt: now.Add(time.Hour), CreatedBy: "someone"},
+		{Matchers: []silence.Matcher{{Name: "a", Value: "b"}}, EndsAt: now.Add(-time.Hour), StartsAt: now.Add(-2 * time.Hour), CreatedBy: "someone"},
+	} {
+		_, err := s.Add(invalid)
+		assert.NotNil(t, err)
+	}
+}
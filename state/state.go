@@ -0,0 +1,244 @@
+// Package state keeps track of the firing state of every alert, which is
+// recorded on every run regardless of whether the alert's actions were
+// performed. The state may be persisted to a json file, so it survives
+// restarts
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tengattack/esalert/config"
+	"github.com/tengattack/esalert/context"
+	"github.com/tengattack/tgo/log"
+)
+
+// State describes the firing state of a single alert
+type State struct {
+	Name string `json:"name"`
+	// Firing is whether the alert's last run would have performed actions
+	Firing bool `json:"firing"`
+	// Labels are the labels of the alert's last notification, including
+	// alertname and severity
+	Labels map[string]string `json:"labels,omitempty"`
+	// Pending is set while the alert is active, but not for long enough to
+	// fire. ActiveSince is when the alert became active, and ActiveRuns the
+	// number of consecutive runs it's been active for
+	Pending     bool      `json:"pending,omitempty"`
+	ActiveSince time.Time `json:"active_since"`
+	ActiveRuns  int       `json:"active_runs,omitempty"`
+	// Since is when Firing last changed
+	Since   time.Time `json:"since"`
+	LastRun time.Time `json:"last_run"`
+	// LastNotified is when the alert's actions were last performed
+	LastNotified time.Time `json:"last_notified,omitempty"`
+	// Suppressed is why the actions of the last run weren't performed even
+	// though the alert was firing, e.g. "muted" or "silenced", or
+	// "dependency" if it wasn't run because an alert it depends on was firing
+	Suppressed string `json:"suppressed,omitempty"`
+	// Escalated is the number of escalation steps performed since the alert
+	// started firing
+	Escalated int `json:"escalated,omitempty"`
+	// Acknowledged is set if someone acknowledged the alert since it started
+	// firing
+	Acknowledged bool `json:"acknowledged,omitempty"`
+	// Transitions are the most recent times Firing changed
+	Transitions []time.Time `json:"transitions,omitempty"`
+	// Flapping is set while the alert changes between firing and resolved
+	// too often, FlapNotified once the notice about it was sent
+	Flapping     bool `json:"flapping,omitempty"`
+	FlapNotified bool `json:"flap_notified,omitempty"`
+	// Previous summarizes the alert's last run, it's only persisted if the
+	// state-previous option is set
+	Previous *context.Previous `json:"previous,omitempty"`
+}
+
+// maxTransitions is the number of transitions kept in a State
+const maxTransitions = 100
+
+var store = struct {
+	sync.RWMutex
+	m     map[string]*State
+	file  string
+	dirty bool          // whether there are changes which weren't saved yet
+	stop  chan struct{} // stops saving the changes periodically
+}{m: map[string]*State{}}
+
+// Open loads the states persisted to the given file, if it exists, and
+// persists all further changes to it every save-interval
+func Open(file string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	m := map[string]*State{}
+	if err == nil {
+		var states []*State
+		if err := json.Unmarshal(b, &states); err != nil {
+			return fmt.Errorf("parsing %s: %s", file, err)
+		}
+		for _, s := range states {
+			m[s.Name] = s
+		}
+	}
+	store.m = m
+	store.file = file
+	if store.stop != nil {
+		close(store.stop)
+	}
+	store.stop = make(chan struct{})
+	go saveLoop(store.stop)
+	return nil
+}
+
+func saveLoop(stop chan struct{}) {
+	interval := config.Opts.SaveInterval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			Flush()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Flush writes the changes which weren't saved yet to the file, if any
+func Flush() {
+	store.Lock()
+	defer store.Unlock()
+	if store.dirty {
+		save()
+		store.dirty = false
+	}
+}
+
+// save writes the states to the file, if any, it must be called with the
+// store locked
+func save() {
+	if store.file == "" {
+		return
+	}
+	states := make([]*State, 0, len(store.m))
+	for _, s := range store.m {
+		if s.Previous != nil && !config.Opts.StatePrevious {
+			sc := *s
+			sc.Previous = nil
+			s = &sc
+		}
+		states = append(states, s)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+
+	b, err := json.MarshalIndent(states, "", "  ")
+	if err == nil {
+		tmp := store.file + ".tmp"
+		if err = ioutil.WriteFile(tmp, b, 0644); err == nil {
+			err = os.Rename(tmp, store.file)
+		}
+	}
+	if err != nil {
+		log.LogError.WithFields(logrus.Fields{
+			"file": store.file,
+			"err":  err,
+		}).Errorln("failed to persist alert state")
+	}
+}
+
+// Get returns the state of the named alert, the zero State (apart from its
+// Name) if it never ran
+func Get(name string) State {
+	store.RLock()
+	defer store.RUnlock()
+	if s, ok := store.m[name]; ok {
+		return *s
+	}
+	return State{Name: name}
+}
+
+// Update calls fn with the state of the named alert, which it may modify, and
+// returns the modified state
+func Update(name string, fn func(*State)) State {
+	store.Lock()
+	defer store.Unlock()
+	s, ok := store.m[name]
+	if !ok {
+		s = &State{Name: name}
+		store.m[name] = s
+	}
+	fn(s)
+	store.dirty = true
+	return *s
+}
+
+// Record records a run of the alert at the given time
+func (s *State) Record(firing bool, labels map[string]string, now time.Time) {
+	if firing != s.Firing && !s.Since.IsZero() {
+		s.Transitions = append(s.Transitions, now)
+		if len(s.Transitions) > maxTransitions {
+			s.Transitions = s.Transitions[len(s.Transitions)-maxTransitions:]
+		}
+	}
+	if firing != s.Firing || s.Since.IsZero() {
+		s.Since = now
+		s.Escalated = 0
+		s.Acknowledged = false
+	}
+	s.Firing = firing
+	s.Labels = labels
+	s.LastRun = now
+	s.Suppressed = ""
+}
+
+// List returns the states of all alerts which ran, ordered by name
+func List() []State {
+	store.RLock()
+	defer store.RUnlock()
+	res := make([]State, 0, len(store.m))
+	for _, s := range store.m {
+		res = append(res, *s)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// Acknowledge marks the named alert as acknowledged until it resolves, it
+// returns false if the alert isn't firing
+func Acknowledge(name string) bool {
+	store.Lock()
+	defer store.Unlock()
+	s, ok := store.m[name]
+	if !ok || !s.Firing {
+		return false
+	}
+	s.Acknowledged = true
+	store.dirty = true
+	return true
+}
+
+// Reset forgets the state of all alerts, and stops persisting it
+func Reset() {
+	store.Lock()
+	defer store.Unlock()
+	if store.stop != nil {
+		close(store.stop)
+		store.stop = nil
+	}
+	store.m = map[string]*State{}
+	store.file = ""
+	store.dirty = false
+}
@@ -0,0 +1,85 @@
+package state_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tengattack/esalert/config"
+	"github.com/tengattack/esalert/context"
+	"github.com/tengattack/esalert/state"
+)
+
+func TestState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "esalert-state")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "state.json")
+	defer state.Reset()
+
+	require.Nil(t, state.Open(file))
+	assert.Empty(t, state.List())
+	assert.False(t, state.Acknowledge("wat"))
+
+	start := time.Now().Round(0)
+	state.Update("wat", func(s *state.State) { s.Record(true, map[string]string{"alertname": "wat"}, start) })
+	state.Update("wat", func(s *state.State) {
+		s.Record(true, map[string]string{"alertname": "wat"}, start.Add(time.Minute))
+		s.Escalated = 2
+	})
+	assert.True(t, state.Acknowledge("wat"))
+
+	// changes are only written periodically, or when flushed
+	_, err = os.Stat(file)
+	assert.True(t, os.IsNotExist(err))
+	state.Flush()
+
+	// the state survives restarts
+	state.Reset()
+	require.Nil(t, state.Open(file))
+	st := state.Get("wat")
+	assert.True(t, st.Firing)
+	assert.True(t, st.Since.Equal(start))
+	assert.True(t, st.LastRun.Equal(start.Add(time.Minute)))
+	assert.Equal(t, 2, st.Escalated)
+	assert.True(t, st.Acknowledged)
+
+	// resolving resets escalation and acknowledgement
+	st = state.Update("wat", func(s *state.State) { s.Record(false, nil, start.Add(2*time.Minute)) })
+	assert.False(t, st.Firing)
+	assert.Equal(t, 0, st.Escalated)
+	assert.False(t, st.Acknowledged)
+	assert.True(t, st.Since.Equal(start.Add(2*time.Minute)))
+	assert.Len(t, state.List(), 1)
+}
+
+func TestStatePrevious(t *testing.T) {
+	dir, err := ioutil.TempDir("", "esalert-state")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "state.json")
+	defer state.Reset()
+	defer func() { config.Opts.StatePrevious = false }()
+
+	prev := &context.Previous{HitCount: 3}
+	require.Nil(t, state.Open(file))
+	state.Update("wat", func(s *state.State) { s.Previous = prev })
+	assert.Equal(t, prev, state.Get("wat").Previous)
+
+	// only kept in memory by default
+	state.Flush()
+	state.Reset()
+	require.Nil(t, state.Open(file))
+	assert.Nil(t, state.Get("wat").Previous)
+
+	config.Opts.StatePrevious = true
+	state.Update("wat", func(s *state.State) { s.Previous = prev })
+	state.Flush()
+	state.Reset()
+	require.Nil(t, state.Open(file))
+	assert.Equal(t, prev, state.Get("wat").Previous)
+}
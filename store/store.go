@@ -0,0 +1,233 @@
+// Package store implements a key/value store shared by all lua vms, so that
+// scripts can keep state (e.g. counters and cooldowns) across runs. Keys are
+// namespaced, by the name of the alert using them, and may expire. The store
+// may be persisted to a json file, so it survives restarts
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tengattack/esalert/config"
+	"github.com/tengattack/tgo/log"
+)
+
+type entry struct {
+	Value   interface{} `json:"value"`
+	Expires time.Time   `json:"expires,omitempty"`
+}
+
+func (e entry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
+
+var store = struct {
+	sync.Mutex
+	m     map[string]map[string]entry
+	file  string
+	dirty bool          // whether there are changes which weren't saved yet
+	stop  chan struct{} // stops saving the changes periodically
+}{m: map[string]map[string]entry{}}
+
+// Open loads the store persisted to the given file, if it exists, and
+// persists all further changes to it every save-interval. Expired keys are
+// dropped every save-interval too. If file is empty the store is only kept in
+// memory
+func Open(file string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	m := map[string]map[string]entry{}
+	if file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			if err := json.Unmarshal(b, &m); err != nil {
+				return fmt.Errorf("parsing %s: %s", file, err)
+			}
+		}
+	}
+	store.m = m
+	store.file = file
+	if store.stop != nil {
+		close(store.stop)
+	}
+	store.stop = make(chan struct{})
+	go saveLoop(store.stop)
+	return nil
+}
+
+func saveLoop(stop chan struct{}) {
+	interval := config.Opts.SaveInterval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			Flush()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Flush drops expired keys, and writes the changes which weren't saved yet to
+// the file, if any
+func Flush() {
+	store.Lock()
+	defer store.Unlock()
+	prune(time.Now())
+	if store.dirty && store.file != "" {
+		save()
+		store.dirty = false
+	}
+}
+
+// prune drops the keys expired at the given time, it must be called with the
+// store locked
+func prune(now time.Time) {
+	for ns, keys := range store.m {
+		for k, e := range keys {
+			if e.expired(now) {
+				del(ns, k)
+			}
+		}
+	}
+}
+
+// save writes the store to the file, it must be called with the store locked
+func save() {
+
+	b, err := json.Marshal(store.m)
+	if err == nil {
+		tmp := store.file + ".tmp"
+		if err = ioutil.WriteFile(tmp, b, 0644); err == nil {
+			err = os.Rename(tmp, store.file)
+		}
+	}
+	if err != nil {
+		log.LogError.WithFields(logrus.Fields{
+			"file": store.file,
+			"err":  err,
+		}).Errorln("failed to persist store")
+	}
+}
+
+// get drops the key if it's expired, it must be called with the store locked
+func get(ns, key string, now time.Time) (entry, bool) {
+	e, ok := store.m[ns][key]
+	if !ok {
+		return entry{}, false
+	}
+	if e.expired(now) {
+		del(ns, key)
+		return entry{}, false
+	}
+	return e, true
+}
+
+// del must be called with the store locked
+func del(ns, key string) {
+	keys, ok := store.m[ns]
+	if !ok {
+		return
+	}
+	delete(keys, key)
+	if len(keys) == 0 {
+		delete(store.m, ns)
+	}
+	store.dirty = true
+}
+
+// set must be called with the store locked
+func set(ns, key string, e entry) {
+	keys, ok := store.m[ns]
+	if !ok {
+		keys = map[string]entry{}
+		store.m[ns] = keys
+	}
+	keys[key] = e
+}
+
+func expiry(now time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
+
+// Get returns the value of the key in the given namespace, and false if it
+// isn't set or expired
+func Get(ns, key string) (interface{}, bool) {
+	store.Lock()
+	defer store.Unlock()
+	e, ok := get(ns, key, time.Now())
+	return e.Value, ok
+}
+
+// Set sets the key in the given namespace to the value, the key expires after
+// ttl unless it's 0
+func Set(ns, key string, value interface{}, ttl time.Duration) {
+	store.Lock()
+	defer store.Unlock()
+	now := time.Now()
+	set(ns, key, entry{Value: value, Expires: expiry(now, ttl)})
+	store.dirty = true
+}
+
+// Incr adds by to the number the key in the given namespace is set to, and
+// returns the result. If the key isn't set it's set to by, expiring after ttl
+// unless it's 0, otherwise its expiry is left as is
+func Incr(ns, key string, by float64, ttl time.Duration) (float64, error) {
+	store.Lock()
+	defer store.Unlock()
+	now := time.Now()
+
+	e, ok := get(ns, key, now)
+	if !ok {
+		e = entry{Value: float64(0), Expires: expiry(now, ttl)}
+	}
+	var n float64
+	switch v := e.Value.(type) {
+	case float64:
+		n = v
+	case int:
+		n = float64(v)
+	default:
+		return 0, fmt.Errorf("value of %s is not a number", key)
+	}
+	e.Value = n + by
+	set(ns, key, e)
+	store.dirty = true
+	return n + by, nil
+}
+
+// Delete unsets the key in the given namespace
+func Delete(ns, key string) {
+	store.Lock()
+	defer store.Unlock()
+	del(ns, key)
+}
+
+// Reset empties the store, and stops persisting it
+func Reset() {
+	store.Lock()
+	defer store.Unlock()
+	if store.stop != nil {
+		close(store.stop)
+		store.stop = nil
+	}
+	store.m = map[string]map[string]entry{}
+	store.file = ""
+	store.dirty = false
+}
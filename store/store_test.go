@@ -0,0 +1,82 @@
+package store_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tengattack/esalert/store"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "esalert-store")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "store.json")
+	defer store.Reset()
+	require.Nil(t, store.Open(file))
+
+	_, ok := store.Get("a", "k")
+	assert.False(t, ok)
+
+	store.Set("a", "k", "v", 0)
+	store.Set("a", "short", "v", 20*time.Millisecond)
+	n, err := store.Incr("a", "count", 2, 20*time.Millisecond)
+	require.Nil(t, err)
+	assert.Equal(t, float64(2), n)
+	n, err = store.Incr("a", "count", 1, time.Hour)
+	require.Nil(t, err)
+	assert.Equal(t, float64(3), n)
+	_, err = store.Incr("a", "k", 1, 0)
+	assert.NotNil(t, err)
+
+	v, ok := store.Get("a", "k")
+	assert.True(t, ok)
+	assert.Equal(t, "v", v)
+	_, ok = store.Get("b", "k")
+	assert.False(t, ok)
+
+	// incr keeps the expiry of the key
+	time.Sleep(30 * time.Millisecond)
+	_, ok = store.Get("a", "short")
+	assert.False(t, ok)
+	_, ok = store.Get("a", "count")
+	assert.False(t, ok)
+
+	store.Set("a", "num", 5, 0)
+	store.Delete("a", "k")
+
+	// changes are only written periodically, or when flushed
+	_, err = os.Stat(file)
+	assert.True(t, os.IsNotExist(err))
+	store.Flush()
+
+	// the store survives restarts
+	store.Reset()
+	require.Nil(t, store.Open(file))
+	_, ok = store.Get("a", "k")
+	assert.False(t, ok)
+	n, err = store.Incr("a", "num", 1, 0)
+	require.Nil(t, err)
+	assert.Equal(t, float64(6), n)
+
+	// expired keys are dropped, and the store works without a file
+	store.Set("a", "short", "v", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	store.Flush()
+	b, err := ioutil.ReadFile(file)
+	require.Nil(t, err)
+	assert.NotContains(t, string(b), "short")
+
+	store.Reset()
+	require.Nil(t, store.Open(""))
+	store.Set("a", "k", "v", 0)
+	store.Flush()
+	v, ok = store.Get("a", "k")
+	assert.True(t, ok)
+	assert.Equal(t, "v", v)
+}